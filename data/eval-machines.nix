@@ -1,8 +1,11 @@
 # Completely stripped down version of nixops' evaluator
-{ networkExpr }:
+{
+  networkExpr ? null,
+  # The network itself instead of a file containing it, e.g. an output of a flake
+  network ? import networkExpr,
+}:
 
 let
-  network = import networkExpr;
   nwPkgs = network.network.pkgs or { };
   lib = network.network.lib or nwPkgs.lib or (import <nixpkgs/lib>);
   evalConfig =
@@ -137,7 +140,9 @@ rec {
             healthChecks
             buildOnly
             substituteOnDestination
+            rebootTimeout
             tags
+            hooks
             ;
           name = n;
           nixosRelease =
@@ -156,6 +161,10 @@ rec {
         meta = {
           description = network.description or "";
           ordering = network.ordering or { };
+          constraints = network.constraints or [ ];
+          webhooks = network.webhooks or [ ];
+          requireConfirmation = network.requireConfirmation or false;
+          confirmationTags = network.confirmationTags or [ ];
         };
       };
 
@@ -172,6 +172,58 @@ let
     };
   });
 
+  hookType = submodule (_: {
+    options = {
+      cmd = mkOption {
+        type = listOf str;
+        description = ''
+          Command to run as list, on the machine running Quetzal, from the directory of the deployment file.
+          The environment contains QUETZAL_HOOK, QUETZAL_HOST, QUETZAL_TARGET_HOST, QUETZAL_TARGET_PORT,
+          QUETZAL_TARGET_USER, QUETZAL_SWITCH_ACTION, QUETZAL_STORE_PATH and QUETZAL_DEPLOYMENT, and for
+          `onFailure` hooks QUETZAL_ERROR and QUETZAL_FAILED_STEP.
+        '';
+      };
+      failurePolicy = mkOption {
+        type = enum [
+          "abort"
+          "continue"
+        ];
+        default = "abort";
+        description = ''
+          What to do if the command fails.
+
+          `abort` (the default) fails the deployment of the host, skipping any remaining hooks of the same kind.
+          `continue` logs the failure and carries on.
+        '';
+      };
+    };
+  });
+
+  hooksType = submodule (_: {
+    options = {
+      preDeploy = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Commands to run before activating the new configuration, after pushing it and pre-deploy checks.";
+      };
+      postActivate = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Commands to run after activating the new configuration, before rebooting and health checks.";
+      };
+      postHealthCheck = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Commands to run at the end of the deployment of the host, after health checks have passed.";
+      };
+      onFailure = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Commands to run if the deployment of the host fails, e.g. to undo a `preDeploy` hook.";
+      };
+    };
+  });
+
 in
 {
   options.deployment = {
@@ -222,6 +274,15 @@ in
       '';
     };
 
+    rebootTimeout = mkOption {
+      type = int;
+      default = 600;
+      description = ''
+        Seconds to wait for the host to come back after rebooting with `quetzal deploy --reboot`,
+        until systemd has finished booting. Overridden by `--reboot-timeout`.
+      '';
+    };
+
     secrets = mkOption {
       default = { };
       example = {
@@ -268,6 +329,15 @@ in
         Host tags.
       '';
     };
+
+    hooks = mkOption {
+      type = hooksType;
+      default = { };
+      description = ''
+        Commands to run locally around the deployment of the host by `quetzal deploy`,
+        e.g. to drain the host from a load balancer before activation and add it back after health checks.
+      '';
+    };
   };
 
   # Creates a txt-file that lists all system healthcheck commands
@@ -1,22 +1,59 @@
 package cliparser
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"strings"
 
 	"github.com/DBCDK/kingpin"
 
 	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
 )
 
+type GenerationsCmdClauses struct {
+	List  *kingpin.CmdClause
+	Prune *kingpin.CmdClause
+}
+
 type KingpinCmdClauses struct {
 	Build         *kingpin.CmdClause
+	Daemon        *kingpin.CmdClause
 	Deploy        *kingpin.CmdClause
+	Diff          *kingpin.CmdClause
 	Eval          *kingpin.CmdClause
 	Execute       *kingpin.CmdClause
+	Generations   *GenerationsCmdClauses
 	HealthCheck   *kingpin.CmdClause
+	History       *kingpin.CmdClause
+	Plan          *kingpin.CmdClause
 	Push          *kingpin.CmdClause
+	Rollback      *kingpin.CmdClause
 	SecretsUpload *kingpin.CmdClause
 	SecretsList   *kingpin.CmdClause
+	Status        *kingpin.CmdClause
+}
+
+var rebootModes = []string{"always", "auto"}
+
+/*
+Prepare the command line for parsing. --reboot takes an optional value, which kingpin doesn't support for flags, so
+--reboot=VALUE is passed as the hidden --reboot-mode=VALUE. A bare --reboot is left alone, as are arguments after "--".
+*/
+func PrepareArgs(args []string) []string {
+	prepared := []string{}
+	for i, arg := range args {
+		if arg == "--" {
+			return append(prepared, args[i:]...)
+		}
+		if mode, found := strings.CutPrefix(arg, "--reboot="); found {
+			arg = "--reboot-mode=" + mode
+		}
+		prepared = append(prepared, arg)
+	}
+
+	return prepared
 }
 
 func New(version string, assetRoot string) (*kingpin.Application, *KingpinCmdClauses, *common.QuetzalOptions) {
@@ -26,32 +63,114 @@ func New(version string, assetRoot string) (*kingpin.Application, *KingpinCmdCla
 		Version:   version,
 		AssetRoot: assetRoot,
 
-		DryRun:          app.Flag("dry-run", "Don't do anything, just eval and print changes").Default("False").Bool(),
+		DryRun:          app.Flag("dry-run", "Build, then show what would change on each host and the commands that would be executed, without executing them").Default("False").Bool(),
 		JsonOut:         app.Flag("i-know-kung-fu", "Output as JSON").Default("False").Bool(),
-		ConstraintsFlag: app.Flag("constraint", "Add constraints to manipulate order of execution").Default("").Strings(),
+		ConstraintsFlag: app.Flag("constraint", "Add constraints to manipulate order and concurrency of execution, e.g. \"hosts tagged db before hosts tagged app\"").Default("").Strings(),
 		KeepGCRoot:      app.Flag("keep-result", "Keep latest build in .gcroots to prevent it from being garbage collected").Default("False").Bool(),
 		AllowBuildShell: app.Flag("allow-build-shell", "Allow using `network.buildShell` to build in a nix-shell which can execute arbitrary commands on the local system").Default("False").Bool(),
+		EventsFile:      app.Flag("events-file", "Write a stream of events describing the progress of the command to a file, as newline delimited JSON").Default("").String(),
+		EventsFd:        app.Flag("events-fd", "Write a stream of events describing the progress of the command to an open file descriptor, as newline delimited JSON").Default("0").Int(),
+		Plain:           app.Flag("plain", "Write plain progress output, instead of showing the progress of each host in full-screen for deploy, push and check-health").Default("False").Bool(),
+		NoEvalCache:     app.Flag("no-eval-cache", "Evaluate the deployment even if a cached evaluation of it is available").Default("False").Bool(),
+
+		OverrideInputs:   app.Flag("override-input", "For deployments in flakes: override an input of the flake, e.g. nixpkgs=github:NixOS/nixpkgs/nixos-24.05 (can be repeated)").PlaceHolder("INPUT=FLAKE").StringMap(),
+		NoUpdateLockFile: app.Flag("no-update-lock-file", "For deployments in flakes: fail if the lock file of the flake is out of date, instead of updating it").Default("False").Bool(),
+		NoWriteLockFile:  app.Flag("no-write-lock-file", "For deployments in flakes: don't write changes to the lock file of the flake").Default("False").Bool(),
 	}
 
 	cmdClauses := &KingpinCmdClauses{
 		Build:         buildCmd(app.Command("build", "Evaluate and build deployment configuration to the local Nix store"), options),
+		Daemon:        daemonCmd(app.Command("daemon", "Serve an HTTP API for listing hosts and running jobs against the deployment"), options),
 		Deploy:        deployCmd(app.Command("deploy", "Build, push and activate new configuration on machines according to switch-action"), options),
+		Diff:          diffCmd(app.Command("diff", "Build and show what would change compared to the systems running on machines"), options),
 		Eval:          evalCmd(app.Command("eval", "Inspect value of an attribute without building"), options),
 		Execute:       executeCmd(app.Command("exec", "Execute arbitrary commands on machines"), options),
+		Generations:   generationsCmd(app.Command("generations", "Manage the generations of the system profile on machines"), options),
 		HealthCheck:   healthCheckCmd(app.Command("check-health", "Run health checks"), options),
+		History:       historyCmd(app.Command("history", "Show the deployments recorded on machines"), options),
+		Plan:          planCmd(app.Command("plan", "Show the steps a deployment would execute, without executing anything"), options),
 		Push:          pushCmd(app.Command("push", "Build and transfer items from the local Nix store to target machines"), options),
+		Rollback:      rollbackCmd(app.Command("rollback", "Switch machines back to a previous configuration"), options),
 		SecretsList:   listSecretsCmd(app.Command("list-secrets", "List secrets"), options),
 		SecretsUpload: uploadSecretsCmd(app.Command("upload-secrets", "Upload secrets"), options),
+		Status:        statusCmd(app.Command("status", "Show which machines are up to date with the deployment"), options),
 	}
 
 	return app, cmdClauses, options
 }
 
+// A deployment file that must exist, or a flake reference
+type deploymentValue struct {
+	target *string
+}
+
+func (value *deploymentValue) Set(deployment string) error {
+	if _, ok := nix.ParseFlakeRef(deployment); !ok {
+		info, err := os.Stat(deployment)
+		if err != nil {
+			return errors.New(fmt.Sprintf("path '%s' does not exist", deployment))
+		}
+		if info.IsDir() {
+			return errors.New(fmt.Sprintf("'%s' is a directory without a flake.nix", deployment))
+		}
+	}
+
+	*value.target = deployment
+	return nil
+}
+
+func (value *deploymentValue) String() string {
+	return *value.target
+}
+
+// The reboot mode, set by a bare --reboot ("always") or by --reboot=MODE, which can't be combined with another mode
+type rebootValue struct {
+	target *string
+	bare   bool
+}
+
+func (value *rebootValue) Set(mode string) error {
+	switch mode {
+	case "true":
+		mode = "always"
+	case "false":
+		*value.target = ""
+		return nil
+	}
+
+	valid := false
+	for _, rebootMode := range rebootModes {
+		valid = valid || mode == rebootMode
+	}
+	if !valid {
+		return errors.New(fmt.Sprintf("invalid reboot mode '%s', must be one of %s", mode, strings.Join(rebootModes, "|")))
+	}
+	if *value.target != "" && *value.target != mode {
+		return errors.New(fmt.Sprintf("--reboot=%s can't be combined with --reboot=%s", *value.target, mode))
+	}
+
+	*value.target = mode
+	return nil
+}
+
+func (value *rebootValue) String() string {
+	return *value.target
+}
+
+func (value *rebootValue) IsBoolFlag() bool {
+	return value.bare
+}
+
+// Repeating --reboot=MODE is checked by Set, instead of failing with the name of the hidden flag
+func (value *rebootValue) IsCumulative() bool {
+	return !value.bare
+}
+
 func deploymentArg(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) {
-	cmd.Arg("deployment", "File containing the nix deployment expression").
+	cmd.Arg("deployment", "File containing the nix deployment expression, or a flake output, e.g. .#quetzal").
 		HintFiles("nix").
 		Required().
-		ExistingFileVar(&cfg.Deployment)
+		SetValue(&deploymentValue{&cfg.Deployment})
 }
 
 func attributeArg(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) {
@@ -154,6 +273,14 @@ func buildCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdCl
 	return cmd
 }
 
+func diffCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
+	selectorFlags(cmd, cfg)
+	showTraceFlag(cmd, cfg)
+	asJsonFlag(cmd, cfg)
+	deploymentArg(cmd, cfg)
+	return cmd
+}
+
 func pushCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
 	selectorFlags(cmd, cfg)
 	showTraceFlag(cmd, cfg)
@@ -167,6 +294,8 @@ func executeCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.Cmd
 	askForSudoPasswdFlag(cmd, cfg)
 	getSudoPasswdCommand(cmd, cfg)
 	timeoutFlag(cmd, cfg)
+	lockFlags(cmd, cfg)
+	yesFlag(cmd, cfg)
 	deploymentArg(cmd, cfg)
 	cmd.
 		Arg("command", "Command to execute").
@@ -176,33 +305,151 @@ func executeCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.Cmd
 	return cmd
 }
 
-func deployCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
+// Flags for the lock taken on hosts by commands changing them
+func lockFlags(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) {
+	cmd.
+		Flag("force-unlock", "Take over the deploy lock on hosts, even if another deployment holds it").
+		Default("False").
+		BoolVar(&cfg.ForceUnlock)
+	cmd.
+		Flag("lock-expiry", "Consider deploy locks that haven't been refreshed for this long stale, and take them over").
+		Default("1h").
+		DurationVar(&cfg.LockExpiry)
+}
+
+func yesFlag(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) {
+	cmd.
+		Flag("yes", "Don't ask for confirmation before changing hosts, even if the deployment requires it").
+		Short('y').
+		Default("False").
+		BoolVar(&cfg.Yes)
+}
+
+// Flags affecting what a deployment does, shared between `deploy` and `plan`
+func deployFlags(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) {
 	switchActions := []string{"dry-activate", "test", "switch", "boot"}
 
 	selectorFlags(cmd, cfg)
 	showTraceFlag(cmd, cfg)
 	deploymentArg(cmd, cfg)
 	timeoutFlag(cmd, cfg)
-	askForSudoPasswdFlag(cmd, cfg)
-	getSudoPasswdCommand(cmd, cfg)
 	skipHealthChecksFlag(cmd, cfg)
 	skipPreDeployChecksFlag(cmd, cfg)
+	yesFlag(cmd, cfg)
 	cmd.
 		Flag("upload-secrets", "Upload secrets as part of the host deployment").
 		Default("False").
 		BoolVar(&cfg.DeployUploadSecrets)
 	cmd.
-		Flag("reboot", "Reboots the host after system activation, but before healthchecks has executed.").
+		Flag("parallel", "Deploy to at most n hosts at the same time").
+		Default("1").
+		IntVar(&cfg.Parallel)
+	cmd.
+		Flag("keep-going", "Continue with the remaining hosts when a host fails, and summarize the outcome of each host at the end").
+		Default("False").
+		BoolVar(&cfg.KeepGoing)
+	cmd.
+		Flag("rollback-on-failure", "Switch hosts back to their previous configuration if health checks fail after activation").
 		Default("False").
-		BoolVar(&cfg.DeployReboot)
+		BoolVar(&cfg.RollbackOnFailure)
+	cmd.
+		Flag("detach", "Activate in a transient systemd unit on the host, so activation continues if the connection is lost, and follow it by reconnecting").
+		Default("False").
+		BoolVar(&cfg.DetachActivation)
+	cmd.
+		Flag("confirm-timeout", "Have hosts roll back to the system they ran before on their own, unless Quetzal reaches them within this many seconds after activation (implies --detach)").
+		Default("0").
+		IntVar(&cfg.ConfirmTimeout)
+	cmd.
+		Flag("reboot", "Reboots the host after system activation, but before healthchecks has executed. With --reboot=auto, only if the kernel, initrd, kernel modules, kernel parameters or systemd changed.").
+		SetValue(&rebootValue{target: &cfg.DeployReboot, bare: true})
+	// --reboot=MODE, see PrepareArgs
+	cmd.
+		Flag("reboot-mode", "").
+		Hidden().
+		SetValue(&rebootValue{target: &cfg.DeployReboot})
+	cmd.
+		Flag("reboot-timeout", "Seconds to wait for rebooted hosts to come back, instead of the reboot timeout of each host").
+		Default("0").
+		IntVar(&cfg.RebootTimeout)
 	cmd.
 		Arg("switch-action", "Either of "+strings.Join(switchActions, "|")).
 		Required().
 		HintOptions(switchActions...).
 		EnumVar(&cfg.DeploySwitchAction, switchActions...)
+}
+
+func deployCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
+	askForSudoPasswdFlag(cmd, cfg)
+	getSudoPasswdCommand(cmd, cfg)
+	lockFlags(cmd, cfg)
+	deployFlags(cmd, cfg)
+	cmd.
+		Flag("log-dir", "Write a log file per host, a log of the whole run and a manifest of the outcome to a new directory under DIR").
+		PlaceHolder("DIR").
+		StringVar(&cfg.LogDir)
+	cmd.
+		Flag("message", "Note to record in the deployment history of the hosts").
+		Short('m').
+		StringVar(&cfg.DeployMessage)
+	cmd.
+		Flag("webhook", "URL to notify about the progress of the deployment, instead of the webhooks of the deployment (can be repeated)").
+		StringsVar(&cfg.WebhookURLs)
+	cmd.
+		Flag("webhook-template", "Go template for the body of webhook notifications, instead of the JSON payload").
+		StringVar(&cfg.WebhookTemplate)
+	return cmd
+}
+
+func planCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
+	asJsonFlag(cmd, cfg)
+	deployFlags(cmd, cfg)
 	return cmd
 }
 
+func daemonCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
+	showTraceFlag(cmd, cfg)
+	getSudoPasswdCommand(cmd, cfg)
+	cmd.
+		Flag("listen", "Address to serve the HTTP API on").
+		Default("127.0.0.1:8118").
+		StringVar(&cfg.DaemonListen)
+	deploymentArg(cmd, cfg)
+	return cmd
+}
+
+func generationsCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *GenerationsCmdClauses {
+	list := cmd.Command("list", "List the generations of the system profile on machines")
+	selectorFlags(list, cfg)
+	showTraceFlag(list, cfg)
+	asJsonFlag(list, cfg)
+	deploymentArg(list, cfg)
+
+	prune := cmd.Command("prune", "Delete old generations of the system profile on machines, never deleting the current generation")
+	selectorFlags(prune, cfg)
+	showTraceFlag(prune, cfg)
+	asJsonFlag(prune, cfg)
+	askForSudoPasswdFlag(prune, cfg)
+	getSudoPasswdCommand(prune, cfg)
+	lockFlags(prune, cfg)
+	prune.
+		Flag("keep", "Keep the n most recent generations").
+		IntVar(&cfg.GenerationsKeep)
+	prune.
+		Flag("older-than", "Delete generations older than this, in days (e.g. 30d) or as a duration (e.g. 12h)").
+		StringVar(&cfg.GenerationsOlderThan)
+	prune.
+		Flag("gc", "Collect garbage in the Nix store afterwards, and report the space freed").
+		Default("False").
+		BoolVar(&cfg.GenerationsGC)
+	deploymentArg(prune, cfg)
+
+	return &GenerationsCmdClauses{
+		List:  list,
+		Prune: prune,
+	}
+}
+
 func healthCheckCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
 	selectorFlags(cmd, cfg)
 	showTraceFlag(cmd, cfg)
@@ -211,12 +458,63 @@ func healthCheckCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin
 	return cmd
 }
 
+func historyCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
+	selectorFlags(cmd, cfg)
+	showTraceFlag(cmd, cfg)
+	asJsonFlag(cmd, cfg)
+	deploymentArg(cmd, cfg)
+	return cmd
+}
+
+func rollbackCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
+	switchActions := []string{"switch", "boot", "test"}
+
+	selectorFlags(cmd, cfg)
+	showTraceFlag(cmd, cfg)
+	askForSudoPasswdFlag(cmd, cfg)
+	getSudoPasswdCommand(cmd, cfg)
+	timeoutFlag(cmd, cfg)
+	skipHealthChecksFlag(cmd, cfg)
+	lockFlags(cmd, cfg)
+	cmd.
+		Flag("generation", "Generation of the system profile to roll back to, instead of the one before the current generation").
+		IntVar(&cfg.RollbackGeneration)
+	cmd.
+		Flag("to", "Store path of a system configuration to roll back to, instead of the one before the current generation").
+		StringVar(&cfg.RollbackTo)
+	cmd.
+		Flag("message", "Note to record in the deployment history of the hosts").
+		Short('m').
+		StringVar(&cfg.DeployMessage)
+	deploymentArg(cmd, cfg)
+	cmd.
+		Arg("switch-action", "Either of "+strings.Join(switchActions, "|")).
+		Required().
+		HintOptions(switchActions...).
+		EnumVar(&cfg.DeploySwitchAction, switchActions...)
+	return cmd
+}
+
+func statusCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
+	selectorFlags(cmd, cfg)
+	showTraceFlag(cmd, cfg)
+	asJsonFlag(cmd, cfg)
+	cmd.
+		Flag("reuse-result", "Compare with the result kept by an earlier build with --keep-result instead of building").
+		Default("False").
+		BoolVar(&cfg.ReuseResult)
+	deploymentArg(cmd, cfg)
+	return cmd
+}
+
 func uploadSecretsCmd(cmd *kingpin.CmdClause, cfg *common.QuetzalOptions) *kingpin.CmdClause {
 	selectorFlags(cmd, cfg)
 	showTraceFlag(cmd, cfg)
 	askForSudoPasswdFlag(cmd, cfg)
 	getSudoPasswdCommand(cmd, cfg)
 	skipHealthChecksFlag(cmd, cfg)
+	lockFlags(cmd, cfg)
+	yesFlag(cmd, cfg)
 	deploymentArg(cmd, cfg)
 	return cmd
 }
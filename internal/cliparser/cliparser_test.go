@@ -0,0 +1,59 @@
+package cliparser
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPrepareArgs(t *testing.T) {
+	args := []string{"deploy", "--reboot=auto", "--reboot", "deployment.nix", "switch", "--", "--reboot=auto"}
+	want := []string{"deploy", "--reboot-mode=auto", "--reboot", "deployment.nix", "switch", "--", "--reboot=auto"}
+	if got := PrepareArgs(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("PrepareArgs(%q) = %q, want %q", args, got, want)
+	}
+}
+
+func TestRebootFlag(t *testing.T) {
+	deployment := filepath.Join(t.TempDir(), "deployment.nix")
+	if err := os.WriteFile(deployment, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		flags []string
+		want  string
+	}{
+		{[]string{}, ""},
+		{[]string{"--reboot"}, "always"},
+		{[]string{"--reboot=always"}, "always"},
+		{[]string{"--reboot=auto"}, "auto"},
+		{[]string{"--reboot=auto", "--reboot=auto"}, "auto"},
+		{[]string{"--no-reboot"}, ""},
+	}
+	for _, test := range tests {
+		cli, _, opts := New("test", "/nonexistent")
+		args := append(append([]string{"deploy"}, test.flags...), deployment, "switch")
+		if _, err := cli.Parse(PrepareArgs(args)); err != nil {
+			t.Errorf("%q: unexpected error: %s", test.flags, err)
+			continue
+		}
+		if opts.DeployReboot != test.want {
+			t.Errorf("%q: got %q, want %q", test.flags, opts.DeployReboot, test.want)
+		}
+	}
+
+	for _, flags := range [][]string{
+		{"--reboot", "--reboot=auto"},
+		{"--reboot=auto", "--reboot"},
+		{"--reboot=always", "--reboot=auto"},
+		{"--reboot=sometimes"},
+	} {
+		cli, _, _ := New("test", "/nonexistent")
+		args := append(append([]string{"deploy"}, flags...), deployment, "switch")
+		if _, err := cli.Parse(PrepareArgs(args)); err == nil {
+			t.Errorf("%q: expected an error", flags)
+		}
+	}
+}
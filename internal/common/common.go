@@ -1,5 +1,16 @@
 package common
 
+import "time"
+
+// Where to send notifications about deployments
+type Webhook struct {
+	URL string
+	// Go template for the body of requests, with the payload as data. Without a template, the payload is sent as JSON.
+	Template string
+	// Content type of the body rendered from the template, JSON by default
+	ContentType string
+}
+
 type QuetzalOptions struct {
 	Version   string
 	AssetRoot string
@@ -9,27 +20,58 @@ type QuetzalOptions struct {
 	ConstraintsFlag *[]string
 	KeepGCRoot      *bool
 	AllowBuildShell *bool
+	EventsFile      *string
+	EventsFd        *int
+	Plain           *bool
+	NoEvalCache     *bool
+	// For deployments in flakes
+	OverrideInputs   *map[string]string
+	NoUpdateLockFile *bool
+	NoWriteLockFile  *bool
 
-	AsJson              bool
-	AskForSudoPasswd    bool
-	AttrKey             string
-	Deployment          string
-	DeploymentsDir      string
-	DeployReboot        bool
-	DeploySwitchAction  string
-	DeployUploadSecrets bool
-	ExecuteCommand      []string
-	NixBuildTarget      string
-	NixBuildTargetFile  string
-	OrderingTags        string
-	PassCmd             string
-	SelectEvery         int
-	SelectGlob          string
-	SelectLimit         int
-	SelectSkip          int
-	SelectTags          string
-	ShowTrace           bool
-	SkipHealthChecks    bool
-	SkipPreDeployChecks bool
-	Timeout             int
+	AsJson               bool
+	AskForSudoPasswd     bool
+	AttrKey              string
+	ConfirmTimeout       int
+	Constraints          []string
+	DaemonListen         string
+	Deployment           string
+	DeploymentsDir       string
+	DeployMessage        string
+	DeployReboot         string
+	DeploySwitchAction   string
+	DeployUploadSecrets  bool
+	DetachActivation     bool
+	ExecuteCommand       []string
+	ForceUnlock          bool
+	GenerationsGC        bool
+	GenerationsKeep      int
+	GenerationsOlderThan string
+	KeepGoing            bool
+	LockExpiry           time.Duration
+	LogDir               string
+	NixBuildTarget       string
+	NixBuildTargetFile   string
+	OrderingTags         string
+	Parallel             int
+	PassCmd              string
+	RequireConfirmation  bool
+	RebootTimeout        int
+	ReuseResult          bool
+	RollbackGeneration   int
+	RollbackOnFailure    bool
+	RollbackTo           string
+	SelectEvery          int
+	SelectGlob           string
+	SelectLimit          int
+	SelectSkip           int
+	SelectTags           string
+	ShowTrace            bool
+	SkipHealthChecks     bool
+	SkipPreDeployChecks  bool
+	Timeout              int
+	WebhookTemplate      string
+	WebhookURLs          []string
+	Webhooks             []Webhook
+	Yes                  bool
 }
@@ -0,0 +1,91 @@
+package constraints
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+type Host interface {
+	GetName() string
+	GetTags() []string
+}
+
+// Selects hosts by name (glob) and/or tag. An empty selector matches all hosts.
+type Selector struct {
+	Name string
+	Tag  string
+
+	nameGlob glob.Glob
+}
+
+// All hosts matching First must be done before any host matching Then is started
+type Ordering struct {
+	First Selector
+	Then  Selector
+}
+
+// At most Limit hosts matching Selector may be in progress at the same time
+type Concurrency struct {
+	Selector Selector
+	Limit    int
+}
+
+type Constraints struct {
+	Orderings   []Ordering
+	Concurrency []Concurrency
+}
+
+func (s Selector) Matches(host Host) bool {
+	if s.nameGlob != nil && !s.nameGlob.Match(host.GetName()) {
+		return false
+	}
+
+	if s.Tag != "" {
+		for _, tag := range host.GetTags() {
+			if tag == s.Tag {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (s Selector) String() string {
+	parts := []string{"hosts"}
+	if s.Name != "" {
+		parts = append(parts, s.Name)
+	}
+	if s.Tag != "" {
+		parts = append(parts, "tagged", s.Tag)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (o Ordering) String() string {
+	return fmt.Sprintf("%s before %s", o.First, o.Then)
+}
+
+func (c Concurrency) String() string {
+	return fmt.Sprintf("at most %d %s at a time", c.Limit, c.Selector)
+}
+
+// Parse a list of constraint expressions, e.g. from `--constraint` or `network.constraints`
+func Parse(expressions []string) (constraints Constraints, err error) {
+	for _, expression := range expressions {
+		if strings.TrimSpace(expression) == "" {
+			continue
+		}
+
+		err = parseConstraint(expression, &constraints)
+		if err != nil {
+			return constraints, err
+		}
+	}
+
+	return constraints, nil
+}
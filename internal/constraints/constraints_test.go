@@ -0,0 +1,160 @@
+package constraints
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testHost struct {
+	name string
+	tags []string
+}
+
+func (h testHost) GetName() string   { return h.name }
+func (h testHost) GetTags() []string { return h.tags }
+
+func hostList(specs ...string) []Host {
+	hosts := []Host{}
+	for _, spec := range specs {
+		name, tags, _ := strings.Cut(spec, ":")
+		host := testHost{name: name}
+		if tags != "" {
+			host.tags = strings.Split(tags, ",")
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+func mustResolve(t *testing.T, expressions []string, hosts []Host) *Graph {
+	t.Helper()
+	c, err := Parse(expressions)
+	if err != nil {
+		t.Fatalf("Parse(%q): %s", expressions, err)
+	}
+	graph, err := c.Resolve(hosts)
+	if err != nil {
+		t.Fatalf("Resolve(%q): %s", expressions, err)
+	}
+	return graph
+}
+
+func orderNames(graph *Graph, hosts []Host) []string {
+	names := []string{}
+	for _, i := range graph.Order() {
+		names = append(names, hosts[i].GetName())
+	}
+	return names
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"hosts tagged db before hosts tagged app", "hosts tagged db before hosts tagged app"},
+		{"host web01 after host db01", "hosts db01 before hosts web01"},
+		{"Hosts web* BEFORE hosts tagged app", "hosts web* before hosts tagged app"},
+		{"at most 1 host tagged etcd at a time", "at most 1 hosts tagged etcd at a time"},
+		{"at most 2 at a time", "at most 2 hosts at a time"},
+	}
+
+	for _, test := range tests {
+		c, err := Parse([]string{test.expression})
+		if err != nil {
+			t.Errorf("Parse(%q): %s", test.expression, err)
+			continue
+		}
+
+		got := ""
+		if len(c.Orderings) == 1 {
+			got = c.Orderings[0].String()
+		} else if len(c.Concurrency) == 1 {
+			got = c.Concurrency[0].String()
+		}
+		if got != test.want {
+			t.Errorf("Parse(%q) = %q, want %q", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expression := range []string{
+		"hosts tagged db",
+		"hosts tagged db before",
+		"hosts tagged before hosts tagged app",
+		"hosts tagged db before hosts tagged db",
+		"at most 0 hosts at a time",
+		"at most two hosts at a time",
+		"at most 1 hosts",
+		"host db01 before host web01 now",
+		"host [ before host web01",
+	} {
+		if _, err := Parse([]string{expression}); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expression)
+		}
+	}
+}
+
+func TestResolveOrder(t *testing.T) {
+	hosts := hostList("app01:app", "db01:db", "web01", "db02:db")
+	graph := mustResolve(t, []string{"hosts tagged db before hosts tagged app", "host web01 after host app01"}, hosts)
+
+	want := []string{"db01", "db02", "app01", "web01"}
+	if got := orderNames(graph, hosts); !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+}
+
+func TestResolveHostsMatchingBothSides(t *testing.T) {
+	hosts := hostList("app01:app", "both01:db,app", "db01:db", "both02:app,db")
+	graph := mustResolve(t, []string{"hosts tagged db before hosts tagged app"}, hosts)
+
+	want := []string{"db01", "both01", "both02", "app01"}
+	if got := orderNames(graph, hosts); !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+
+	// hosts matching both sides don't wait for each other
+	for _, dep := range graph.Dependencies(1) {
+		if hosts[dep].GetName() == "both02" {
+			t.Errorf("both01 depends on both02")
+		}
+	}
+}
+
+func TestResolveContradiction(t *testing.T) {
+	c, err := Parse([]string{"host a before host b", "host b before host a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Resolve(hostList("a", "b"))
+	if err == nil || !strings.Contains(err.Error(), "contradict") {
+		t.Errorf("Resolve() = %v, want a contradiction", err)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	hosts := hostList("etcd01:etcd", "etcd02:etcd", "web01")
+	graph := mustResolve(t, []string{"at most 1 host tagged etcd at a time"}, hosts)
+
+	scheduler := graph.Scheduler(3)
+	first, ok := scheduler.Next()
+	if !ok || hosts[first].GetName() != "etcd01" {
+		t.Fatalf("Next() = %d, %v, want etcd01", first, ok)
+	}
+
+	// etcd02 has to wait for etcd01, but web01 doesn't
+	second, ok := scheduler.Next()
+	if !ok || hosts[second].GetName() != "web01" {
+		t.Fatalf("Next() = %d, %v, want web01", second, ok)
+	}
+
+	scheduler.Done(first, nil)
+	third, ok := scheduler.Next()
+	if !ok || hosts[third].GetName() != "etcd02" {
+		t.Fatalf("Next() = %d, %v, want etcd02", third, ok)
+	}
+}
@@ -0,0 +1,146 @@
+package constraints
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Constraints resolved against a specific list of hosts
+type Graph struct {
+	hosts []Host
+	// dependencies[i] lists the hosts that must be done before host i can be started
+	dependencies [][]int
+	limits       []limit
+}
+
+type limit struct {
+	max     int
+	members map[int]bool
+}
+
+// Resolve the constraints for a list of hosts. Fails if the ordering constraints contradict each other.
+func (c Constraints) Resolve(hosts []Host) (*Graph, error) {
+	graph := &Graph{
+		hosts:        hosts,
+		dependencies: make([][]int, len(hosts)),
+	}
+
+	for _, ordering := range c.Orderings {
+		for i, first := range hosts {
+			if !ordering.First.Matches(first) {
+				continue
+			}
+			for j, then := range hosts {
+				// a host matching both sides of a constraint can't be ordered relative to itself, nor relative to other
+				// hosts matching both sides, e.g. hosts tagged both db and app for "hosts tagged db before hosts tagged app"
+				if i == j || !ordering.Then.Matches(then) {
+					continue
+				}
+				if ordering.Then.Matches(first) && ordering.First.Matches(then) {
+					continue
+				}
+				graph.dependencies[j] = append(graph.dependencies[j], i)
+			}
+		}
+	}
+
+	for _, concurrency := range c.Concurrency {
+		l := limit{max: concurrency.Limit, members: make(map[int]bool)}
+		for i, host := range hosts {
+			if concurrency.Selector.Matches(host) {
+				l.members[i] = true
+			}
+		}
+		graph.limits = append(graph.limits, l)
+	}
+
+	if cycle := graph.findCycle(); cycle != nil {
+		// the cycle follows dependencies, so reverse it to list the hosts in the order they were asked to run in
+		names := []string{}
+		for k := len(cycle) - 1; k >= 0; k-- {
+			names = append(names, hosts[cycle[k]].GetName())
+		}
+		return nil, errors.New(fmt.Sprintf("Constraints contradict each other, hosts would have to run in a loop: %s", strings.Join(names, " before ")))
+	}
+
+	return graph, nil
+}
+
+// Find a cycle in the dependencies, returned as a list of host indexes, or nil if there is none
+func (graph *Graph) findCycle() []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(graph.hosts))
+	var stack []int
+	var cycle []int
+
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, dep := range graph.dependencies[i] {
+			if state[dep] == visiting {
+				// the cycle is the part of the stack starting at dep
+				for k, s := range stack {
+					if s == dep {
+						cycle = append(append(cycle, stack[k:]...), dep)
+						break
+					}
+				}
+				return true
+			}
+			if state[dep] == unvisited && visit(dep) {
+				return true
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		return false
+	}
+
+	for i := range graph.hosts {
+		if state[i] == unvisited && visit(i) {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+// The hosts that must be done before host i can be started
+func (graph *Graph) Dependencies(i int) []int {
+	return graph.dependencies[i]
+}
+
+// The order hosts would be handled in when running one host at a time.
+// Hosts keep their original position, unless they have to wait for other hosts.
+func (graph *Graph) Order() []int {
+	done := make([]bool, len(graph.hosts))
+	order := make([]int, 0, len(graph.hosts))
+
+	for len(order) < len(graph.hosts) {
+		for i := range graph.hosts {
+			if !done[i] && graph.dependenciesDone(i, done) {
+				done[i] = true
+				order = append(order, i)
+				break
+			}
+		}
+	}
+
+	return order
+}
+
+func (graph *Graph) dependenciesDone(i int, done []bool) bool {
+	for _, dep := range graph.dependencies[i] {
+		if !done[dep] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package constraints
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+/*
+The constraint grammar is a handful of english-like sentences:
+
+	constraint  = ordering | concurrency
+	ordering    = selector ( "before" | "after" ) selector
+	concurrency = "at" "most" <n> [ selector ] "at" "a" "time"
+	selector    = ( "host" | "hosts" ) [ <name-glob> ] [ "tagged" <tag> ]
+
+Examples:
+
+	hosts tagged db before hosts tagged app
+	at most 1 host tagged etcd at a time
+	host web01 after host db01
+*/
+
+var keywords = map[string]bool{
+	"after":  true,
+	"at":     true,
+	"before": true,
+	"tagged": true,
+}
+
+type parser struct {
+	expression string
+	tokens     []string
+	pos        int
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() string {
+	token := p.peek()
+	if token != "" {
+		p.pos++
+	}
+	return token
+}
+
+// Consume the next token if it's the given keyword
+func (p *parser) accept(keyword string) bool {
+	if strings.ToLower(p.peek()) == keyword {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(keywords ...string) error {
+	for _, keyword := range keywords {
+		if !p.accept(keyword) {
+			return p.errorf("expected '%s'", keyword)
+		}
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	found := p.peek()
+	if found == "" {
+		found = "end of constraint"
+	}
+	message := fmt.Sprintf(format, args...)
+	return errors.New(fmt.Sprintf("Invalid constraint \"%s\": %s, found '%s'", p.expression, message, found))
+}
+
+func parseConstraint(expression string, constraints *Constraints) error {
+	p := &parser{
+		expression: expression,
+		tokens:     strings.Fields(expression),
+	}
+
+	if p.accept("at") {
+		concurrency, err := p.parseConcurrency()
+		if err != nil {
+			return err
+		}
+		constraints.Concurrency = append(constraints.Concurrency, concurrency)
+	} else {
+		ordering, err := p.parseOrdering()
+		if err != nil {
+			return err
+		}
+		constraints.Orderings = append(constraints.Orderings, ordering)
+	}
+
+	if p.peek() != "" {
+		return p.errorf("unexpected trailing input")
+	}
+
+	return nil
+}
+
+func (p *parser) parseOrdering() (ordering Ordering, err error) {
+	left, err := p.parseSelector()
+	if err != nil {
+		return ordering, err
+	}
+
+	var before bool
+	if p.accept("before") {
+		before = true
+	} else if p.accept("after") {
+		before = false
+	} else {
+		return ordering, p.errorf("expected 'before' or 'after'")
+	}
+
+	right, err := p.parseSelector()
+	if err != nil {
+		return ordering, err
+	}
+
+	if left.Name == right.Name && left.Tag == right.Tag {
+		return ordering, errors.New(fmt.Sprintf("Invalid constraint \"%s\": hosts can't be ordered relative to themselves", p.expression))
+	}
+
+	if before {
+		return Ordering{First: left, Then: right}, nil
+	}
+	return Ordering{First: right, Then: left}, nil
+}
+
+func (p *parser) parseConcurrency() (concurrency Concurrency, err error) {
+	if err = p.expect("most"); err != nil {
+		return concurrency, err
+	}
+
+	limit, err := strconv.Atoi(p.peek())
+	if err != nil || limit < 1 {
+		return concurrency, p.errorf("expected a positive number")
+	}
+	p.next()
+
+	// "at most 2 at a time" is shorthand for "at most 2 hosts at a time"
+	if strings.ToLower(p.peek()) != "at" {
+		concurrency.Selector, err = p.parseSelector()
+		if err != nil {
+			return concurrency, err
+		}
+	}
+
+	if err = p.expect("at", "a", "time"); err != nil {
+		return concurrency, err
+	}
+
+	concurrency.Limit = limit
+	return concurrency, nil
+}
+
+func (p *parser) parseSelector() (selector Selector, err error) {
+	if !p.accept("host") && !p.accept("hosts") {
+		return selector, p.errorf("expected 'host' or 'hosts'")
+	}
+
+	if token := p.peek(); token != "" && !keywords[strings.ToLower(token)] {
+		selector.Name = p.next()
+		selector.nameGlob, err = glob.Compile(selector.Name)
+		if err != nil {
+			return selector, errors.New(fmt.Sprintf("Invalid constraint \"%s\": invalid host name pattern '%s': %s", p.expression, selector.Name, err))
+		}
+	}
+
+	if p.accept("tagged") {
+		if token := p.peek(); token == "" || keywords[strings.ToLower(token)] {
+			return selector, p.errorf("expected a tag")
+		}
+		selector.Tag = p.next()
+	}
+
+	return selector, nil
+}
@@ -0,0 +1,135 @@
+package constraints
+
+import (
+	"sync"
+)
+
+const (
+	pending = iota
+	running
+	succeeded
+	failed
+)
+
+// Hands out hosts in an order that respects the constraints, and with at most `parallel` hosts running at a time
+type Scheduler struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	graph    *Graph
+	order    []int
+	parallel int
+	state    []int
+	running  int
+	stopped  bool
+}
+
+func (graph *Graph) Scheduler(parallel int) *Scheduler {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	s := &Scheduler{
+		graph:    graph,
+		order:    graph.Order(),
+		parallel: parallel,
+		state:    make([]int, len(graph.hosts)),
+	}
+	s.cond = sync.NewCond(&s.lock)
+
+	return s
+}
+
+// Wait for the next host that may be started, and mark it as running.
+// Returns false when no more hosts will be started, either because all hosts have been handed out, the scheduler was
+// stopped, or because the remaining hosts depend on hosts that failed.
+func (s *Scheduler) Next() (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		if s.stopped {
+			return -1, false
+		}
+
+		if s.running < s.parallel {
+			for _, i := range s.order {
+				if s.state[i] == pending && s.ready(i) {
+					s.state[i] = running
+					s.running++
+					return i, true
+				}
+			}
+		}
+
+		if s.running == 0 {
+			return -1, false
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// Mark a host returned by Next as done
+func (s *Scheduler) Done(i int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err != nil {
+		s.state[i] = failed
+	} else {
+		s.state[i] = succeeded
+	}
+	s.running--
+
+	s.cond.Broadcast()
+}
+
+// Stop handing out new hosts. Hosts already running are unaffected.
+func (s *Scheduler) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopped = true
+
+	s.cond.Broadcast()
+}
+
+// Hosts that were never started
+func (s *Scheduler) Pending() (hosts []Host) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, state := range s.state {
+		if state == pending {
+			hosts = append(hosts, s.graph.hosts[i])
+		}
+	}
+
+	return hosts
+}
+
+func (s *Scheduler) ready(i int) bool {
+	for _, dep := range s.graph.dependencies[i] {
+		if s.state[dep] != succeeded {
+			return false
+		}
+	}
+
+	for _, l := range s.graph.limits {
+		if !l.members[i] {
+			continue
+		}
+
+		active := 0
+		for member := range l.members {
+			if s.state[member] == running {
+				active++
+			}
+		}
+		if active >= l.max {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,97 @@
+package cruft
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+	"github.com/quetzal-deploy/quetzal/internal/utils"
+)
+
+// Whether the deployment insists on asking before changing the hosts, either always or for hosts with certain tags
+func requiresConfirmation(meta nix.DeploymentMetadata, hosts []nix.Host) bool {
+	if meta.RequireConfirmation {
+		return true
+	}
+
+	for _, host := range hosts {
+		for _, tag := range host.GetTags() {
+			for _, confirmationTag := range meta.ConfirmationTags {
+				if tag == confirmationTag {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+/*
+Show the hosts about to be changed and ask whether to go on. With a result path, each host is described by whether it
+would change. Without a terminal to ask on, the command goes on, unless the deployment requires confirmation.
+*/
+func confirmHosts(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, action string, hosts []nix.Host, resultPath string) error {
+	if opts.Yes {
+		return nil
+	}
+	if !utils.StdinIsTerminal() {
+		if opts.RequireConfirmation {
+			return errors.New("The deployment requires confirmation, but stdin isn't a terminal to ask on. Pass --yes to go ahead anyway.")
+		}
+		return nil
+	}
+
+	var question strings.Builder
+	count := 0
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+		count++
+
+		description := host.Name
+		if tags := host.GetTags(); len(tags) > 0 {
+			description += fmt.Sprintf(" [%s]", strings.Join(tags, ","))
+		}
+		if resultPath != "" {
+			description += ": " + describeChange(sshContext, host, resultPath)
+		}
+		fmt.Fprintf(&question, "\t* %s\n", description)
+	}
+	question.WriteString("Continue?")
+
+	// show what's been published so far before the question
+	events.Flush()
+	confirmed, err := utils.Confirm(fmt.Sprintf("\nAbout to %s on %d host(s):\n%s", action, count, question.String()))
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return errors.New("Aborted, nothing was changed.")
+	}
+
+	return nil
+}
+
+// Whether activating the result would change what the host is running
+func describeChange(sshContext *ssh.SSHContext, host nix.Host, resultPath string) string {
+	declared, err := nix.GetNixSystemPath(host, resultPath)
+	if err != nil {
+		return "not part of the build"
+	}
+
+	current, err := sshContext.ReadLink(&host, ssh.CurrentSystem)
+	if err != nil {
+		return "unreachable"
+	}
+	if current == declared {
+		return "up to date"
+	}
+
+	return "would change"
+}
@@ -1,18 +1,24 @@
 package cruft
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
 	"github.com/quetzal-deploy/quetzal/internal/filter"
 	"github.com/quetzal-deploy/quetzal/internal/healthchecks"
+	"github.com/quetzal-deploy/quetzal/internal/logdir"
 	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/planner"
 	"github.com/quetzal-deploy/quetzal/internal/ssh"
 	"github.com/quetzal-deploy/quetzal/internal/utils"
+	"github.com/quetzal-deploy/quetzal/internal/webhooks"
 )
 
 func ExecBuild(opts *common.QuetzalOptions, hosts []nix.Host) (string, error) {
@@ -23,134 +29,104 @@ func ExecBuild(opts *common.QuetzalOptions, hosts []nix.Host) (string, error) {
 	return resultPath, nil
 }
 
-func ExecDeploy(opts *common.QuetzalOptions, hosts []nix.Host) (string, error) {
-	sshContext := ssh.CreateSSHContext(opts)
-
-	doPush := false
-	doUploadSecrets := false
-	doActivate := false
-
-	if !*opts.DryRun {
-		switch opts.DeploySwitchAction {
-		case "dry-activate":
-			doPush = true
-			doActivate = true
-		case "test":
-			fallthrough
-		case "switch":
-			fallthrough
-		case "boot":
-			doPush = true
-			doUploadSecrets = opts.DeployUploadSecrets
-			doActivate = true
-		}
-	}
-
-	resultPath, err := buildHosts(opts, hosts)
+func ExecDeploy(opts *common.QuetzalOptions, hosts []nix.Host) (resultPath string, err error) {
+	plan, err := planner.PlanDeploy(opts, hosts)
 	if err != nil {
 		return "", err
 	}
 
-	fmt.Fprintln(os.Stderr)
-
-	for _, host := range hosts {
-		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Deployment steps are disabled for build-only host: %s\n", host.Name)
-			continue
+	if opts.LogDir != "" {
+		runDir, dirErr := logdir.New(opts.LogDir, "deploy", plan.Hosts)
+		if dirErr != nil {
+			return "", dirErr
 		}
-
-		singleHostInList := []nix.Host{host}
-
-		if doPush {
-			err = pushPaths(sshContext, singleHostInList, resultPath)
-			if err != nil {
-				return "", err
+		events.Subscribe(events.NewQueuedSubscriber(runDir))
+		events.Publish(events.Log{Message: "Writing logs to " + runDir.Path})
+		// write the manifest even when interrupted
+		utils.AddFinalizer(func() {
+			events.Flush()
+			runDir.Close(errors.New("Interrupted"))
+		})
+		defer func() {
+			events.Flush()
+			if closeErr := runDir.Close(err); closeErr != nil {
+				fmt.Fprintf(os.Stderr, "Unable to write the manifest of the run: %s\n", closeErr)
 			}
-		}
-		fmt.Fprintln(os.Stderr)
-
-		if doUploadSecrets {
-			phase := "pre-activation"
-			err = ExecUploadSecrets(opts, singleHostInList, &phase)
-			if err != nil {
-				return "", err
-			}
-
-			fmt.Fprintln(os.Stderr)
-		}
-
-		if !opts.SkipPreDeployChecks {
-			err := healthchecks.PerformPreDeployChecks(sshContext, &host, opts.Timeout)
-			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host pre-deploy check failed.")
-				utils.Exit(1)
-			}
-		}
-
-		if doActivate {
-			err = activateConfiguration(opts, singleHostInList, resultPath)
-			if err != nil {
-				return "", err
-			}
-		}
-
-		if opts.DeployReboot {
-			err = host.Reboot(sshContext)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Reboot failed")
-				return "", err
-			}
-		}
-
-		if doUploadSecrets {
-			phase := "post-activation"
-			err = ExecUploadSecrets(opts, singleHostInList, &phase)
-			if err != nil {
-				return "", err
-			}
-
-			fmt.Fprintln(os.Stderr)
-		}
+		}()
+	}
 
-		if !opts.SkipHealthChecks {
-			err := healthchecks.PerformHealthChecks(sshContext, &host, opts.Timeout)
-			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host health check failed.")
-				utils.Exit(1)
-			}
-		}
+	sshContext := ssh.CreateSSHContext(opts)
 
-		fmt.Fprintln(os.Stderr, "Done:", host.Name)
+	if len(opts.Webhooks) > 0 && !*opts.DryRun {
+		deploymentPath, _ := nix.DeploymentPath(opts.Deployment)
+		notifier := webhooks.NewNotifier(opts.Webhooks, deploymentPath)
+		events.Subscribe(notifier)
+		defer notifier.Close()
 	}
 
-	return resultPath, nil
+	return runPlan(opts, sshContext, plan, hosts, "deploy")
 }
 
 func ExecEval(opts *common.QuetzalOptions) (string, error) {
-	deploymentFile, err := os.Open(opts.Deployment)
-	deploymentPath, err := filepath.Abs(deploymentFile.Name())
+	deploymentPath, err := nix.DeploymentPath(opts.Deployment)
 	if err != nil {
 		return "", err
 	}
 
-	path, err := nix.GetNixContext(opts).EvalHosts(deploymentPath, opts.AttrKey)
+	value, err := nix.GetNixContext(opts).EvalHosts(deploymentPath, opts.AttrKey)
+	if err != nil {
+		return value, err
+	}
+
+	events.Publish(events.Evaluated{Attribute: opts.AttrKey, Value: value})
+	if !*opts.JsonOut {
+		fmt.Print(value)
+	}
 
-	return path, err
+	return value, nil
 }
 
 func ExecExecute(opts *common.QuetzalOptions, hosts []nix.Host) error {
 	sshContext := ssh.CreateSSHContext(opts)
 
+	if *opts.DryRun {
+		for _, host := range hosts {
+			if host.BuildOnly {
+				continue
+			}
+			command, err := sshContext.CommandLine(&host, opts.ExecuteCommand...)
+			if err != nil {
+				return err
+			}
+			events.Publish(events.DryRunCommand{Host: host.Name, Step: "exec", Command: command})
+		}
+		return nil
+	}
+
+	// ask first, so nobody is locked out while the question is open
+	err := confirmHosts(opts, sshContext, fmt.Sprintf("execute `%s`", strings.Join(opts.ExecuteCommand, " ")), hosts, "")
+	if err != nil {
+		return err
+	}
+
+	release, err := lockHosts(opts, sshContext, hosts, "exec")
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	for _, host := range hosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Exec is disabled for build-only host: %s\n", host.Name)
+			events.Publish(events.Log{Host: host.Name, Message: "Exec is disabled for build-only host: " + host.Name})
 			continue
 		}
-		fmt.Fprintln(os.Stderr, "** "+host.Name)
-		sshContext.CmdInteractive(&host, opts.Timeout, opts.ExecuteCommand...)
-		fmt.Fprintln(os.Stderr)
+		events.Publish(events.Log{Host: host.Name, Message: "** " + host.Name})
+		events.Publish(events.HostStarted{Host: host.Name})
+		start := time.Now()
+		// A failing command doesn't prevent executing it on the remaining hosts
+		err := sshContext.WithOutput(events.NewOutputWriter(host.Name)).CmdInteractive(&host, opts.Timeout, opts.ExecuteCommand...)
+		events.Publish(events.HostFinished{Host: host.Name, Duration: time.Since(start), Error: events.ErrorString(err)})
+		events.Publish(events.Log{Host: host.Name})
 	}
 
 	return nil
@@ -162,10 +138,13 @@ func ExecHealthCheck(opts *common.QuetzalOptions, hosts []nix.Host) error {
 	var err error
 	for _, host := range hosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Healthchecks are disabled for build-only host: %s\n", host.Name)
+			events.Publish(events.HostSkipped{Host: host.Name, Reason: "Healthchecks are disabled for build-only host"})
 			continue
 		}
-		err = healthchecks.PerformHealthChecks(sshContext, &host, opts.Timeout)
+		events.Publish(events.HostStarted{Host: host.Name})
+		start := time.Now()
+		err = healthchecks.PerformHealthChecks(sshContext.WithOutput(events.NewOutputWriter(host.Name)), &host, opts.Timeout)
+		events.Publish(events.HostFinished{Host: host.Name, Duration: time.Since(start), Error: events.ErrorString(err)})
 	}
 
 	if err != nil {
@@ -176,24 +155,16 @@ func ExecHealthCheck(opts *common.QuetzalOptions, hosts []nix.Host) error {
 }
 
 func ExecPush(opts *common.QuetzalOptions, hosts []nix.Host) (string, error) {
-	sshContext := ssh.CreateSSHContext(opts)
-
-	resultPath, err := ExecBuild(opts, hosts)
+	plan, err := planner.PlanPush(opts, hosts)
 	if err != nil {
 		return "", err
 	}
 
-	fmt.Fprintln(os.Stderr)
-	return resultPath, pushPaths(sshContext, hosts, resultPath)
+	return runPlan(opts, ssh.CreateSSHContext(opts), plan, hosts, "")
 }
 
 func GetHosts(opts *common.QuetzalOptions) (hosts []nix.Host, err error) {
-	deploymentFile, err := os.Open(opts.Deployment)
-	if err != nil {
-		return hosts, err
-	}
-
-	deploymentAbsPath, err := filepath.Abs(deploymentFile.Name())
+	deploymentAbsPath, err := nix.DeploymentPath(opts.Deployment)
 	if err != nil {
 		return hosts, err
 	}
@@ -225,35 +196,70 @@ func GetHosts(opts *common.QuetzalOptions) (hosts []nix.Host, err error) {
 
 	filteredHosts := filter.FilterHosts(sortedHosts, opts.SelectSkip, opts.SelectEvery, opts.SelectLimit)
 
-	fmt.Fprintf(os.Stderr, "Selected %v/%v hosts (name filter:-%v, limits:-%v):\n", len(filteredHosts), len(deployment.Hosts), len(deployment.Hosts)-len(matchingHosts), len(matchingHosts)-len(filteredHosts))
-	for index, host := range filteredHosts {
-		fmt.Fprintf(os.Stderr, "\t%3d: %s (secrets: %d, health checks: %d, tags: %s)\n", index, host.Name, len(host.Secrets), len(host.HealthChecks.Cmd)+len(host.HealthChecks.Http), strings.Join(host.GetTags(), ","))
+	// Constraints are checked against all hosts, so contradictions are caught no matter which hosts are selected
+	opts.Constraints = []string{}
+	for _, constraint := range append(deployment.Meta.Constraints, *opts.ConstraintsFlag...) {
+		if strings.TrimSpace(constraint) != "" {
+			opts.Constraints = append(opts.Constraints, constraint)
+		}
+	}
+	if _, err = planner.ResolveConstraints(opts.Constraints, deployment.Hosts); err != nil {
+		return hosts, err
 	}
-	fmt.Fprintln(os.Stderr)
 
-	return filteredHosts, nil
-}
+	opts.RequireConfirmation = requiresConfirmation(deployment.Meta, filteredHosts)
 
-func activateConfiguration(opts *common.QuetzalOptions, filteredHosts []nix.Host, resultPath string) error {
-	sshContext := ssh.CreateSSHContext(opts)
+	// Webhooks given on the command line replace those of the deployment
+	opts.Webhooks = deployment.Meta.Webhooks
+	if len(opts.WebhookURLs) > 0 {
+		opts.Webhooks = []common.Webhook{}
+		for _, url := range opts.WebhookURLs {
+			opts.Webhooks = append(opts.Webhooks, common.Webhook{URL: url})
+		}
+	}
+	if opts.WebhookTemplate != "" {
+		for i := range opts.Webhooks {
+			opts.Webhooks[i].Template = opts.WebhookTemplate
+		}
+	}
 
-	fmt.Fprintln(os.Stderr, "Executing '"+opts.DeploySwitchAction+"' on matched hosts:")
-	fmt.Fprintln(os.Stderr)
+	filteredHosts, err = planner.SortHosts(opts.Constraints, filteredHosts)
+	if err != nil {
+		return hosts, err
+	}
+
+	selected := events.HostsSelected{
+		Total:        len(deployment.Hosts),
+		NameFiltered: len(deployment.Hosts) - len(matchingHosts),
+		Limited:      len(matchingHosts) - len(filteredHosts),
+		Hosts:        []events.SelectedHost{},
+	}
 	for _, host := range filteredHosts {
+		selected.Hosts = append(selected.Hosts, events.SelectedHost{
+			Name:         host.Name,
+			Secrets:      len(host.Secrets),
+			HealthChecks: len(host.HealthChecks.Cmd) + len(host.HealthChecks.Http),
+			Tags:         host.GetTags(),
+		})
+	}
+	events.Publish(selected)
 
-		fmt.Fprintln(os.Stderr, "** "+host.Name)
+	return filteredHosts, nil
+}
 
+func activateConfiguration(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath string, switchAction string) error {
+	for _, host := range filteredHosts {
 		configuration, err := nix.GetNixSystemPath(host, resultPath)
 		if err != nil {
 			return err
 		}
 
-		err = sshContext.ActivateConfiguration(&host, configuration, opts.DeploySwitchAction)
+		events.Publish(events.ActivationStarted{Host: host.Name, SwitchAction: switchAction, Configuration: configuration})
+		err = sshContext.ActivateConfiguration(&host, configuration, switchAction)
+		events.Publish(events.ActivationFinished{Host: host.Name, SwitchAction: switchAction, Configuration: configuration, Error: events.ErrorString(err)})
 		if err != nil {
 			return err
 		}
-
-		fmt.Fprintln(os.Stderr)
 	}
 
 	return nil
@@ -265,7 +271,7 @@ func buildHosts(opts *common.QuetzalOptions, hosts []nix.Host) (resultPath strin
 		return
 	}
 
-	deploymentPath, err := filepath.Abs(opts.Deployment)
+	deploymentPath, err := nix.DeploymentPath(opts.Deployment)
 	if err != nil {
 		return
 	}
@@ -279,22 +285,39 @@ func buildHosts(opts *common.QuetzalOptions, hosts []nix.Host) (resultPath strin
 		nixBuildTargets = fmt.Sprintf("{ \"out\" = %s; }", opts.NixBuildTarget)
 	}
 
+	hostNames := []string{}
+	for _, host := range hosts {
+		hostNames = append(hostNames, host.Name)
+	}
+	events.Publish(events.BuildStarted{Hosts: hostNames})
+
 	nixContext := nix.GetNixContext(opts)
 	resultPath, err = nixContext.BuildMachines(deploymentPath, hosts, nixBuildTargets)
 
 	if err != nil {
+		events.Publish(events.BuildFinished{Error: err.Error()})
 		return
 	}
 
-	fmt.Fprintln(os.Stderr, "nix result path: ")
-	fmt.Println(resultPath)
+	paths := make(map[string]string)
+	for _, host := range hosts {
+		if path, err := nix.GetNixSystemPath(host, resultPath); err == nil {
+			paths[host.Name] = path
+		}
+	}
+	events.Publish(events.BuildFinished{ResultPath: resultPath, Paths: paths})
+
+	// with JSON output the result path is part of the report instead
+	if !*opts.JsonOut && !opts.AsJson {
+		fmt.Println(resultPath)
+	}
 	return
 }
 
 func pushPaths(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath string) error {
 	for _, host := range filteredHosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Push is disabled for build-only host: %s\n", host.Name)
+			events.Publish(events.Log{Host: host.Name, Message: "Push is disabled for build-only host: " + host.Name})
 			continue
 		}
 
@@ -302,11 +325,9 @@ func pushPaths(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(os.Stderr, "Pushing paths to %v (%v@%v):\n", host.Name, host.TargetUser, host.TargetHost)
-		for _, path := range paths {
-			fmt.Fprintf(os.Stderr, "\t* %s\n", path)
-		}
+		events.Publish(events.PushStarted{Host: host.Name, TargetUser: host.TargetUser, TargetHost: host.TargetHost, Paths: paths})
 		err = nix.Push(sshContext, host, paths...)
+		events.Publish(events.PushFinished{Host: host.Name, Error: events.ErrorString(err)})
 		if err != nil {
 			return err
 		}
@@ -314,3 +335,13 @@ func pushPaths(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath
 
 	return nil
 }
+
+// Print the output of a command as indented JSON on stdout
+func printJson(value interface{}) error {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(encoded))
+	return nil
+}
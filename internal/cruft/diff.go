@@ -0,0 +1,98 @@
+package cruft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/diff"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+type hostDiff struct {
+	Host string `json:"host"`
+	*diff.SystemDiff
+	Error string `json:"error,omitempty"`
+}
+
+func ExecDiff(opts *common.QuetzalOptions, hosts []nix.Host) error {
+	resultPath, err := buildHosts(opts, hosts)
+	if err != nil {
+		return err
+	}
+
+	sshContext := ssh.CreateSSHContext(opts)
+
+	diffs := []hostDiff{}
+	for _, host := range hosts {
+		if host.BuildOnly {
+			events.Publish(events.HostSkipped{Host: host.Name, Reason: "Build-only host, nothing to compare against"})
+			continue
+		}
+
+		// An unreachable host doesn't prevent comparing the remaining hosts
+		systemDiff, diffErr := diffSystem(sshContext, host, resultPath)
+		if diffErr != nil {
+			err = diffErr
+			events.Publish(events.Log{Host: host.Name, Message: fmt.Sprintf("Couldn't compare %s with the new build: %s", host.Name, diffErr.Error())})
+		}
+		diffs = append(diffs, hostDiff{Host: host.Name, SystemDiff: systemDiff, Error: events.ErrorString(diffErr)})
+	}
+
+	if opts.AsJson {
+		if jsonErr := printJson(diffs); jsonErr != nil {
+			return jsonErr
+		}
+	} else {
+		for _, hostDiff := range diffs {
+			fmt.Printf("%s:\n", hostDiff.Host)
+			if hostDiff.Error != "" {
+				fmt.Printf("\tCouldn't compare: %s\n", hostDiff.Error)
+				continue
+			}
+			hostDiff.Print(os.Stdout)
+		}
+	}
+
+	if err != nil {
+		err = errors.New("Couldn't compare one or more hosts with the new build")
+	}
+
+	return err
+}
+
+// Compare the system running on the host with its system in the new build
+func diffSystem(sshContext *ssh.SSHContext, host nix.Host, resultPath string) (*diff.SystemDiff, error) {
+	current, err := sshContext.ReadLink(&host, ssh.CurrentSystem)
+	if err != nil {
+		return nil, err
+	}
+
+	configuration, err := nix.GetNixSystemPath(host, resultPath)
+	if err != nil {
+		return nil, err
+	}
+
+	oldSystem, err := nix.GetSystemInfo(sshContext, &host, current)
+	if err != nil {
+		return nil, err
+	}
+
+	newSystem, err := nix.GetSystemInfo(sshContext, nil, configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	systemDiff := diff.CompareSystems(oldSystem, newSystem)
+	if systemDiff.Changed {
+		systemDiff.Closure, err = diffClosures(sshContext, host, current, configuration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return systemDiff, nil
+}
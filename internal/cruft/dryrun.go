@@ -0,0 +1,142 @@
+package cruft
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/quetzal-deploy/quetzal/internal/diff"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/planner"
+	"github.com/quetzal-deploy/quetzal/internal/secrets"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+	"github.com/quetzal-deploy/quetzal/internal/utils"
+)
+
+// Compare the system running on the host with the new build, and publish what would change
+func diffHost(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+	current, err := sshContext.ReadLink(&host, ssh.CurrentSystem)
+	if err != nil {
+		return err
+	}
+
+	configuration, err := nix.GetNixSystemPath(host, resultPath)
+	if err != nil {
+		return err
+	}
+
+	changes := events.HostChanges{
+		Host:          host.Name,
+		CurrentSystem: current,
+		NewSystem:     configuration,
+		WouldChange:   current != configuration,
+	}
+
+	if changes.WouldChange {
+		changes.Closure, err = diffClosures(sshContext, host, current, configuration)
+		if err != nil {
+			return err
+		}
+	}
+
+	events.Publish(changes)
+	return nil
+}
+
+// Compare the closure of a system on the host with a closure in the local store
+func diffClosures(sshContext *ssh.SSHContext, host nix.Host, remotePath string, localPath string) (*diff.ClosureDiff, error) {
+	oldSizes, err := nix.GetClosureSizes(sshContext, &host, remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	newSizes, err := nix.GetClosureSizes(sshContext, nil, localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return diff.CompareClosures(oldSizes, newSizes), nil
+}
+
+// Publish the commands a step would execute, without executing them
+func (run *planRun) describeStep(sshContext *ssh.SSHContext, host nix.Host, step *planner.Step) error {
+	var commands []string
+
+	switch step.Type {
+	case planner.StepPush:
+		paths, err := nix.GetPathsToPush(host, run.resultPath)
+		if err != nil {
+			return err
+		}
+		commands = nix.PushCommandLines(sshContext, host, paths...)
+
+	case planner.StepUploadSecrets:
+		deploymentDir, err := nix.DeploymentDir(run.opts.Deployment)
+		if err != nil {
+			return err
+		}
+		postUploadActions := make(map[string][]string)
+		names := []string{}
+		for name := range host.Secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			secret := host.Secrets[name]
+			// an empty phase means uploading secrets no matter what phase they want
+			if step.Phase != "" && secret.UploadAt != step.Phase {
+				continue
+			}
+			commands = append(commands, secrets.UploadCommandLines(sshContext, &host, secret, deploymentDir)...)
+			if len(secret.Action) > 0 {
+				postUploadActions[strings.Join(secret.Action, " ")] = secret.Action
+			}
+		}
+		for _, action := range postUploadActions {
+			command, err := sshContext.CommandLine(&host, action...)
+			if err != nil {
+				return err
+			}
+			commands = append(commands, command)
+		}
+
+	case planner.StepActivate:
+		configuration, err := nix.GetNixSystemPath(host, run.resultPath)
+		if err != nil {
+			return err
+		}
+		commands = sshContext.ActivationCommandLines(&host, configuration, step.SwitchAction)
+
+	case planner.StepHook:
+		for _, hook := range host.Hooks.ForPhase(step.Phase) {
+			commands = append(commands, utils.ShellJoin(hook.Cmd...)+" (locally)")
+		}
+
+	case planner.StepReboot:
+		command, err := sshContext.CommandLine(&host, "sudo", "reboot")
+		if err != nil {
+			return err
+		}
+
+		if step.OnlyIfNeeded {
+			needed, reason, err := rebootReason(sshContext, host, run.resultPath, run.plan.SwitchAction)
+			if err != nil {
+				return err
+			}
+			if !needed {
+				events.Publish(events.Log{Host: host.Name, Message: fmt.Sprintf("Wouldn't reboot %s with --reboot=auto, since %s", host.Name, reason)})
+				return nil
+			}
+			command += fmt.Sprintf(" (only with --reboot=auto, since %s)", reason)
+		}
+		commands = append(commands, command)
+	}
+
+	for _, command := range commands {
+		events.Publish(events.DryRunCommand{Host: host.Name, Step: step.ID, Command: command})
+	}
+
+	return nil
+}
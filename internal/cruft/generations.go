@@ -0,0 +1,233 @@
+package cruft
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/diff"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+type hostGenerations struct {
+	Host        string           `json:"host"`
+	Generations []nix.Generation `json:"generations"`
+	Error       string           `json:"error,omitempty"`
+}
+
+type hostPrune struct {
+	Host    string `json:"host"`
+	Deleted []int  `json:"deleted"`
+	// Only set when garbage was collected
+	FreedBytes *int64 `json:"freedBytes,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func ExecGenerationsList(opts *common.QuetzalOptions, hosts []nix.Host) error {
+	sshContext := ssh.CreateSSHContext(opts)
+
+	results := []hostGenerations{}
+	var err error
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+
+		generations, listErr := nix.ListGenerations(sshContext, &host)
+		if listErr != nil {
+			err = listErr
+		}
+		results = append(results, hostGenerations{Host: host.Name, Generations: generations, Error: events.ErrorString(listErr)})
+	}
+
+	if opts.AsJson {
+		if jsonErr := printJson(results); jsonErr != nil {
+			return jsonErr
+		}
+	} else {
+		for _, result := range results {
+			fmt.Printf("%s:\n", result.Host)
+			if result.Error != "" {
+				fmt.Printf("\tCouldn't list generations: %s\n", result.Error)
+				continue
+			}
+			for _, generation := range result.Generations {
+				current := ""
+				if generation.Current {
+					current = " (current)"
+				}
+				fmt.Printf("\t%4d  %s  %s%s\n", generation.Number, generation.Date, generation.Path, current)
+			}
+		}
+	}
+
+	if err != nil {
+		err = errors.New("Couldn't list the generations of one or more hosts")
+	}
+
+	return err
+}
+
+// Parse an age like nix-env does, as a number of days (e.g. 30d), or as a duration (e.g. 12h)
+func parseAge(age string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(age, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("Invalid age: %s", age))
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(age)
+}
+
+// Select the generations to delete, reading the time on the host with hostTime if needed. The current generation is
+// always kept.
+func generationsToPrune(opts *common.QuetzalOptions, generations []nix.Generation, hostTime func() (time.Time, error)) ([]int, error) {
+	prune := []int{}
+
+	if opts.GenerationsKeep > 0 {
+		for i, generation := range generations {
+			if i < len(generations)-opts.GenerationsKeep && !generation.Current {
+				prune = append(prune, generation.Number)
+			}
+		}
+		return prune, nil
+	}
+
+	maxAge, err := parseAge(opts.GenerationsOlderThan)
+	if err != nil {
+		return nil, err
+	}
+	// the dates of generations are in the timezone of the host, so compare them with the time on the host
+	now, err := hostTime()
+	if err != nil {
+		return nil, err
+	}
+	for _, generation := range generations {
+		created, err := generation.Time()
+		if err != nil {
+			return nil, err
+		}
+		if now.Sub(created) > maxAge && !generation.Current {
+			prune = append(prune, generation.Number)
+		}
+	}
+
+	return prune, nil
+}
+
+func pruneHost(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, host nix.Host) (result hostPrune, err error) {
+	result.Host = host.Name
+
+	generations, err := nix.ListGenerations(sshContext, &host)
+	if err != nil {
+		return
+	}
+
+	result.Deleted, err = generationsToPrune(opts, generations, func() (time.Time, error) {
+		return nix.GetHostTime(sshContext, &host)
+	})
+	if err != nil {
+		return
+	}
+
+	if *opts.DryRun {
+		events.Publish(events.Log{Host: host.Name, Message: fmt.Sprintf("Would delete %d generations on %s", len(result.Deleted), host.Name)})
+		return
+	}
+
+	if len(result.Deleted) > 0 {
+		err = nix.DeleteGenerations(sshContext, &host, result.Deleted)
+		if err != nil {
+			return
+		}
+	}
+
+	if opts.GenerationsGC {
+		events.Publish(events.Log{Host: host.Name, Message: "Collecting garbage on " + host.Name})
+		var freed int64
+		freed, err = nix.CollectGarbage(sshContext, &host)
+		if err != nil {
+			return
+		}
+		result.FreedBytes = &freed
+	}
+
+	return
+}
+
+func ExecGenerationsPrune(opts *common.QuetzalOptions, hosts []nix.Host) error {
+	if (opts.GenerationsKeep > 0) == (opts.GenerationsOlderThan != "") {
+		return errors.New("Exactly one of --keep and --older-than must be used")
+	}
+	if opts.GenerationsOlderThan != "" {
+		if _, err := parseAge(opts.GenerationsOlderThan); err != nil {
+			return err
+		}
+	}
+
+	sshContext := ssh.CreateSSHContext(opts)
+
+	release, err := lockHosts(opts, sshContext, hosts, "generations prune")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	results := []hostPrune{}
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+
+		events.Publish(events.HostStarted{Host: host.Name})
+		start := time.Now()
+		result, pruneErr := pruneHost(opts, sshContext.WithOutput(events.NewOutputWriter(host.Name)), host)
+		result.Error = events.ErrorString(pruneErr)
+		events.Publish(events.HostFinished{Host: host.Name, Duration: time.Since(start), Error: result.Error})
+		if pruneErr != nil {
+			err = pruneErr
+		}
+		results = append(results, result)
+	}
+
+	if opts.AsJson {
+		if jsonErr := printJson(results); jsonErr != nil {
+			return jsonErr
+		}
+	} else {
+		for _, result := range results {
+			fmt.Printf("%s:\n", result.Host)
+			if result.Error != "" {
+				fmt.Printf("\tFailed: %s\n", result.Error)
+				continue
+			}
+			deleted := []string{}
+			for _, number := range result.Deleted {
+				deleted = append(deleted, strconv.Itoa(number))
+			}
+			if len(deleted) == 0 {
+				fmt.Println("\tNo generations to delete")
+			} else if *opts.DryRun {
+				fmt.Printf("\tWould delete generations: %s\n", strings.Join(deleted, ", "))
+			} else {
+				fmt.Printf("\tDeleted generations: %s\n", strings.Join(deleted, ", "))
+			}
+			if result.FreedBytes != nil {
+				fmt.Printf("\tFreed: %s\n", diff.FormatSize(*result.FreedBytes))
+			}
+		}
+	}
+
+	if err != nil {
+		err = errors.New("Couldn't prune the generations of one or more hosts")
+	}
+
+	return err
+}
@@ -0,0 +1,115 @@
+package cruft
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+)
+
+func testGenerations() []nix.Generation {
+	return []nix.Generation{
+		{Number: 38, Date: "2024-04-01 12:00:00"},
+		{Number: 39, Date: "2024-04-20 12:00:00"},
+		{Number: 40, Date: "2024-04-28 12:00:00", Current: true},
+		{Number: 41, Date: "2024-04-30 12:00:00"},
+		{Number: 42, Date: "2024-05-01 11:00:00"},
+	}
+}
+
+func hostTimeAt(date string) func() (time.Time, error) {
+	return func() (time.Time, error) {
+		return time.Parse(time.DateTime, date)
+	}
+}
+
+func TestGenerationsToPrune(t *testing.T) {
+	tests := []struct {
+		name      string
+		keep      int
+		olderThan string
+		want      []int
+	}{
+		{"keep the newest", 2, "", []int{38, 39}},
+		{"keep the newest, not counting the current", 1, "", []int{38, 39, 41}},
+		{"keep more than there are", 10, "", []int{}},
+		{"older than days", 0, "10d", []int{38, 39}},
+		{"older than more days", 0, "20d", []int{38}},
+		{"older than a duration", 0, "12h", []int{38, 39, 41}},
+		{"the current generation is kept however old", 0, "1h", []int{38, 39, 41}},
+		{"nothing old enough", 0, "60d", []int{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &common.QuetzalOptions{GenerationsKeep: test.keep, GenerationsOlderThan: test.olderThan}
+			got, err := generationsToPrune(opts, testGenerations(), hostTimeAt("2024-05-01 12:00:00"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGenerationsToPruneKeepDoesntAskHost(t *testing.T) {
+	opts := &common.QuetzalOptions{GenerationsKeep: 3}
+	_, err := generationsToPrune(opts, testGenerations(), func() (time.Time, error) {
+		return time.Time{}, errors.New("unreachable")
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestGenerationsToPruneErrors(t *testing.T) {
+	unreachable := func() (time.Time, error) { return time.Time{}, errors.New("unreachable") }
+	tests := []struct {
+		name        string
+		olderThan   string
+		generations []nix.Generation
+		hostTime    func() (time.Time, error)
+	}{
+		{"invalid days", "xd", testGenerations(), hostTimeAt("2024-05-01 12:00:00")},
+		{"invalid duration", "soon", testGenerations(), hostTimeAt("2024-05-01 12:00:00")},
+		{"host time unavailable", "10d", testGenerations(), unreachable},
+		{"invalid date", "10d", []nix.Generation{{Number: 1, Date: "yesterday"}}, hostTimeAt("2024-05-01 12:00:00")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &common.QuetzalOptions{GenerationsOlderThan: test.olderThan}
+			if got, err := generationsToPrune(opts, test.generations, test.hostTime); err == nil {
+				t.Errorf("expected an error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		age  string
+		want time.Duration
+	}{
+		{"30d", 30 * 24 * time.Hour},
+		{"0d", 0},
+		{"12h", 12 * time.Hour},
+		{"90m", 90 * time.Minute},
+	}
+
+	for _, test := range tests {
+		got, err := parseAge(test.age)
+		if err != nil {
+			t.Errorf("parseAge(%q): unexpected error: %s", test.age, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseAge(%q) = %s, want %s", test.age, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package cruft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/history"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+// Record a successful activation in the history of the host. The deployment already happened, so failing to record it
+// only results in a warning.
+func recordHistory(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, host nix.Host, configuration string, switchAction string, previousConfiguration string, message string) {
+	deploymentPath, err := nix.DeploymentPath(opts.Deployment)
+	if err == nil {
+		record := history.NewRecord(deploymentPath, switchAction, configuration, previousConfiguration, message)
+		err = history.Append(sshContext, &host, record)
+	}
+
+	if err != nil {
+		events.Publish(events.Log{Host: host.Name, Message: "Warning: couldn't record the deployment in the history of the host: " + err.Error()})
+	}
+}
+
+type hostHistory struct {
+	Host    string           `json:"host"`
+	Records []history.Record `json:"records"`
+	Error   string           `json:"error,omitempty"`
+}
+
+func ExecHistory(opts *common.QuetzalOptions, hosts []nix.Host) error {
+	sshContext := ssh.CreateSSHContext(opts)
+
+	histories := []hostHistory{}
+	var err error
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+
+		records, readErr := history.Read(sshContext, &host)
+		if readErr != nil {
+			err = readErr
+		}
+		histories = append(histories, hostHistory{Host: host.Name, Records: records, Error: events.ErrorString(readErr)})
+	}
+
+	if opts.AsJson {
+		if jsonErr := printJson(histories); jsonErr != nil {
+			return jsonErr
+		}
+	} else {
+		for _, hostHistory := range histories {
+			fmt.Printf("%s:\n", hostHistory.Host)
+			if hostHistory.Error != "" {
+				fmt.Printf("\tCouldn't read history: %s\n", hostHistory.Error)
+				continue
+			}
+			history.Print(os.Stdout, hostHistory.Records)
+		}
+	}
+
+	if err != nil {
+		err = errors.New("Couldn't read the history of one or more hosts")
+	}
+
+	return err
+}
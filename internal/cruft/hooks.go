@@ -0,0 +1,50 @@
+package cruft
+
+import (
+	"fmt"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/hooks"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+)
+
+// The environment hooks of a host are run with
+func hookEnv(opts *common.QuetzalOptions, host nix.Host, resultPath string, phase string) []string {
+	storePath, _ := nix.GetNixSystemPath(host, resultPath)
+	deploymentPath, _ := nix.DeploymentPath(opts.Deployment)
+
+	return []string{
+		"QUETZAL_HOOK=" + phase,
+		"QUETZAL_HOST=" + host.Name,
+		"QUETZAL_TARGET_HOST=" + host.TargetHost,
+		fmt.Sprintf("QUETZAL_TARGET_PORT=%d", host.TargetPort),
+		"QUETZAL_TARGET_USER=" + host.TargetUser,
+		"QUETZAL_SWITCH_ACTION=" + opts.DeploySwitchAction,
+		"QUETZAL_STORE_PATH=" + storePath,
+		"QUETZAL_DEPLOYMENT=" + deploymentPath,
+	}
+}
+
+// Run the hooks of the host for a phase on this machine, from the directory of the deployment
+func runHooks(opts *common.QuetzalOptions, host nix.Host, resultPath string, phase string, extraEnv ...string) error {
+	env := append(hookEnv(opts, host, resultPath, phase), extraEnv...)
+	deploymentDir, err := nix.DeploymentDir(opts.Deployment)
+	if err != nil {
+		return err
+	}
+
+	return hooks.Run(host.Name, phase, host.Hooks.ForPhase(phase), deploymentDir, env, events.NewOutputWriter(host.Name))
+}
+
+// Run the onFailure hooks of a host after a step failed. The host has already failed, so errors are only logged.
+func runFailureHooks(opts *common.QuetzalOptions, host nix.Host, resultPath string, failedStep string, err error) {
+	if len(host.Hooks.OnFailure) == 0 || *opts.DryRun {
+		return
+	}
+
+	hookErr := runHooks(opts, host, resultPath, hooks.OnFailure, "QUETZAL_ERROR="+err.Error(), "QUETZAL_FAILED_STEP="+failedStep)
+	if hookErr != nil {
+		events.Publish(events.Log{Host: host.Name, Message: "Warning: " + hookErr.Error()})
+	}
+}
@@ -0,0 +1,60 @@
+package cruft
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/lock"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+	"github.com/quetzal-deploy/quetzal/internal/utils"
+)
+
+// Take the deploy lock on all hosts before touching any of them. The returned function releases the locks, and is
+// also run if Quetzal is interrupted.
+func lockHosts(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, hosts []nix.Host, command string) (release func(), err error) {
+	var (
+		locks []*lock.Lock
+		once  sync.Once
+	)
+	release = func() {
+		once.Do(func() {
+			for _, l := range locks {
+				if err := l.Release(); err != nil {
+					events.Publish(events.Log{Message: err.Error()})
+				}
+			}
+		})
+	}
+
+	// nothing is changed on the hosts in a dry run
+	if *opts.DryRun {
+		return release, nil
+	}
+
+	holder, err := lock.NewHolder(command)
+	if err != nil {
+		return release, err
+	}
+
+	for i := range hosts {
+		host := &hosts[i]
+		if host.BuildOnly {
+			continue
+		}
+
+		l, err := lock.Acquire(sshContext, host, holder, opts.LockExpiry, opts.ForceUnlock)
+		if err != nil {
+			release()
+			return release, err
+		}
+		locks = append(locks, l)
+		events.Publish(events.Log{Host: host.Name, Message: fmt.Sprintf("Locked %s", host.Name)})
+	}
+
+	utils.AddFinalizer(release)
+
+	return release, nil
+}
@@ -0,0 +1,95 @@
+package cruft
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/quetzal-deploy/quetzal/internal/constraints"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/planner"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+type hostFunc func(sshContext *ssh.SSHContext, host nix.Host) error
+
+// Run fn for each host, in an order respecting the constraints, and with at most `parallel` hosts in progress at the
+// same time. Output of commands run on a host is published as events tied to that host.
+//
+// When running sequentially (parallel <= 1) the first error stops execution.
+// When running in parallel, a failing host prevents new hosts from being started, but hosts already in progress are
+// allowed to finish.
+// With keepGoing, failing hosts don't stop anything, except hosts that have to wait for them according to the
+// constraints. The errors of all failed hosts are returned.
+func forEachHost(sshContext *ssh.SSHContext, hosts []nix.Host, parallel int, constraintExprs []string, keepGoing bool, fn hostFunc) error {
+	graph, err := planner.ResolveConstraints(constraintExprs, hosts)
+	if err != nil {
+		return err
+	}
+	scheduler := graph.Scheduler(parallel)
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		errs []error
+	)
+
+	if parallel <= 1 {
+		for {
+			i, ok := scheduler.Next()
+			if !ok {
+				break
+			}
+
+			host := hosts[i]
+			err := fn(sshContext.WithOutput(events.NewOutputWriter(host.Name)), host)
+			scheduler.Done(i, err)
+			if err != nil {
+				if !keepGoing {
+					return err
+				}
+				errs = append(errs, fmt.Errorf("%s: %w", host.Name, err))
+			}
+		}
+
+		return notStarted(scheduler, errs)
+	}
+
+	for {
+		i, ok := scheduler.Next()
+		if !ok {
+			break
+		}
+		host := hosts[i]
+
+		wg.Add(1)
+		go func(i int, host nix.Host) {
+			defer wg.Done()
+
+			err := fn(sshContext.WithOutput(events.NewOutputWriter(host.Name)), host)
+
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", host.Name, err))
+				lock.Unlock()
+				if !keepGoing {
+					scheduler.Stop()
+				}
+			}
+			scheduler.Done(i, err)
+		}(i, host)
+	}
+
+	wg.Wait()
+
+	return notStarted(scheduler, errs)
+}
+
+func notStarted(scheduler *constraints.Scheduler, errs []error) error {
+	if pending := scheduler.Pending(); len(errs) > 0 && len(pending) > 0 {
+		events.Publish(events.Log{Message: fmt.Sprintf("Not started, since a host failed: %d host(s)", len(pending))})
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,270 @@
+package cruft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/healthchecks"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/planner"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+// State shared between the steps of a plan while it's being executed
+type planRun struct {
+	opts       *common.QuetzalOptions
+	plan       *planner.Plan
+	hosts      []nix.Host
+	resultPath string
+	report     *deployReport
+	// The command to lock the hosts for, after the global steps, or empty to not lock them
+	lockCommand string
+}
+
+// State shared between the steps of a single host
+type hostRun struct {
+	host                  nix.Host
+	rollbackConfiguration string
+}
+
+func ExecPlan(opts *common.QuetzalOptions, hosts []nix.Host) error {
+	plan, err := planner.PlanDeploy(opts, hosts)
+	if err != nil {
+		return err
+	}
+
+	if opts.AsJson {
+		return plan.PrintJson(os.Stdout)
+	}
+
+	plan.Print(os.Stdout)
+	return nil
+}
+
+/*
+Execute a plan. Steps not tied to a host (i.e. building and confirming) are run first, followed by the steps of each
+host in order. Hosts are handled according to the parallelism and constraints of the plan. With a lock command, the
+hosts are locked in between, so they aren't locked while building or waiting for confirmation.
+*/
+func runPlan(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, plan *planner.Plan, hosts []nix.Host, lockCommand string) (string, error) {
+	run := &planRun{
+		opts:        opts,
+		plan:        plan,
+		hosts:       hosts,
+		report:      &deployReport{},
+		lockCommand: lockCommand,
+	}
+
+	events.Publish(events.RunStarted{Command: plan.Command, SwitchAction: plan.SwitchAction, Hosts: plan.Hosts})
+
+	err := run.run(sshContext)
+
+	finished := events.RunFinished{Command: plan.Command, RolledBack: run.report.Rollbacks()}
+	if plan.KeepGoing {
+		finished.Summary = run.report.Summary(plan.Hosts)
+		// the summary tells which hosts failed and why
+		if failed := run.report.Failed(); failed > 0 {
+			err = errors.New(fmt.Sprintf("%d of %d host(s) failed", failed, len(plan.Hosts)))
+		}
+	}
+	finished.Error = events.ErrorString(err)
+	events.Publish(finished)
+
+	return run.resultPath, err
+}
+
+func (run *planRun) run(sshContext *ssh.SSHContext) error {
+	for _, step := range run.plan.GlobalSteps() {
+		err := run.runStep(sshContext, nil, step)
+		if err != nil {
+			return err
+		}
+	}
+
+	if run.lockCommand != "" {
+		release, err := lockHosts(run.opts, sshContext, run.hosts, run.lockCommand)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	return forEachHost(sshContext, run.hosts, run.plan.Parallel, run.plan.Constraints, run.plan.KeepGoing, func(sshContext *ssh.SSHContext, host nix.Host) error {
+		if reason, ok := run.plan.Skipped[host.Name]; ok {
+			events.Publish(events.HostSkipped{Host: host.Name, Reason: reason})
+			run.report.addOutcome(host.Name, outcomeSkipped, "", nil)
+			return nil
+		}
+
+		events.Publish(events.HostStarted{Host: host.Name})
+		start := time.Now()
+
+		hostRun := &hostRun{host: host}
+		var err error
+		for _, step := range run.plan.HostSteps(host.Name) {
+			err = run.runStep(sshContext, hostRun, step)
+			if err != nil {
+				runFailureHooks(run.opts, host, run.resultPath, step.ID, err)
+				run.report.addOutcome(host.Name, outcomeFailed, string(step.Type), err)
+				break
+			}
+		}
+		if err == nil {
+			run.report.addOutcome(host.Name, outcomeSucceeded, "", nil)
+		}
+
+		events.Publish(events.HostFinished{Host: host.Name, Duration: time.Since(start), Error: events.ErrorString(err)})
+		return err
+	})
+}
+
+func (run *planRun) runStep(sshContext *ssh.SSHContext, hostRun *hostRun, step *planner.Step) (err error) {
+	events.Publish(events.StepStarted{Host: step.Host, Step: step.ID, StepType: string(step.Type)})
+	start := time.Now()
+
+	defer func() {
+		events.Publish(events.StepFinished{
+			Host:     step.Host,
+			Step:     step.ID,
+			StepType: string(step.Type),
+			Duration: time.Since(start),
+			Error:    events.ErrorString(err),
+		})
+	}()
+
+	opts := run.opts
+
+	if step.DryRun {
+		return run.describeStep(sshContext, hostRun.host, step)
+	}
+
+	switch step.Type {
+	case planner.StepBuild:
+		run.resultPath, err = buildHosts(opts, run.hosts)
+		if err != nil {
+			return err
+		}
+
+	case planner.StepDiff:
+		err = diffHost(sshContext, hostRun.host, run.resultPath)
+		if err != nil {
+			return err
+		}
+
+	case planner.StepPush:
+		err = pushPaths(sshContext, []nix.Host{hostRun.host}, run.resultPath)
+		if err != nil {
+			return err
+		}
+
+	case planner.StepUploadSecrets:
+		// an empty phase means uploading secrets no matter what phase they want
+		var phase *string
+		if step.Phase != "" {
+			phase = &step.Phase
+		}
+		err = secretsUpload(opts, sshContext, []nix.Host{hostRun.host}, phase)
+		if err != nil {
+			return err
+		}
+
+	case planner.StepPreDeployChecks:
+		err = healthchecks.PerformPreDeployChecks(sshContext, &hostRun.host, opts.Timeout)
+		if err != nil {
+			if run.plan.KeepGoing {
+				return errors.New("Pre-deploy checks failed, not deploying to this host.")
+			}
+			return errors.New("Not deploying to additional hosts, since a host pre-deploy check failed.")
+		}
+
+	case planner.StepActivate:
+		// Remember what the host is running before activation, for the history, and so it can be restored if the
+		// health checks fail. Only the rollback depends on it, the history doesn't block deploying.
+		previousConfiguration, err := getRollbackConfiguration(sshContext, hostRun.host, step.SwitchAction)
+		if err != nil {
+			if step.RollbackOnFailure {
+				return err
+			}
+			events.Publish(events.Log{Host: hostRun.host.Name, Message: "Warning: couldn't read the configuration before activation, for the history of the host: " + err.Error()})
+			previousConfiguration = ""
+		}
+		if step.RollbackOnFailure {
+			hostRun.rollbackConfiguration = previousConfiguration
+		}
+
+		err = activateConfiguration(sshContext, []nix.Host{hostRun.host}, run.resultPath, step.SwitchAction)
+		if err != nil {
+			return err
+		}
+
+		if step.SwitchAction != "dry-activate" {
+			configuration, err := nix.GetNixSystemPath(hostRun.host, run.resultPath)
+			if err != nil {
+				return err
+			}
+			recordHistory(opts, sshContext, hostRun.host, configuration, step.SwitchAction, previousConfiguration, opts.DeployMessage)
+		}
+
+	case planner.StepConfirm:
+		err = confirmHosts(opts, sshContext, describeAction(run.plan), run.hosts, run.resultPath)
+		if err != nil {
+			return err
+		}
+
+	case planner.StepHook:
+		err = runHooks(opts, hostRun.host, run.resultPath, step.Phase)
+		if err != nil {
+			return err
+		}
+
+	case planner.StepReboot:
+		if step.OnlyIfNeeded {
+			needed, err := rebootNeeded(sshContext, hostRun.host, run.resultPath, run.plan.SwitchAction)
+			if err != nil {
+				return err
+			}
+			if !needed {
+				return nil
+			}
+		}
+
+		err = hostRun.host.Reboot(sshContext, opts.RebootTimeout)
+		if err != nil {
+			events.Publish(events.Log{Host: hostRun.host.Name, Message: "Reboot failed"})
+			return err
+		}
+
+	case planner.StepHealthChecks:
+		err = healthchecks.PerformHealthChecks(sshContext, &hostRun.host, opts.Timeout)
+		if err != nil {
+			if step.RollbackOnFailure && hostRun.rollbackConfiguration != "" {
+				run.report.addRollback(hostRun.host.Name, hostRun.rollbackConfiguration, rollbackHost(opts, sshContext, hostRun.host, hostRun.rollbackConfiguration))
+			}
+			if run.plan.KeepGoing {
+				return errors.New("Health checks failed.")
+			}
+			return errors.New("Not continuing with additional hosts, since a host health check failed.")
+		}
+
+	default:
+		return errors.New(fmt.Sprintf("Unknown step type: %s", step.Type))
+	}
+
+	return nil
+}
+
+// What carrying out the plan does to hosts, e.g. "deploy 'switch'"
+func describeAction(plan *planner.Plan) string {
+	switch plan.Command {
+	case "deploy":
+		return fmt.Sprintf("deploy '%s'", plan.SwitchAction)
+	case "upload-secrets":
+		return "upload secrets"
+	default:
+		return plan.Command
+	}
+}
@@ -0,0 +1,65 @@
+package cruft
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/quetzal-deploy/quetzal/internal/diff"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+/*
+Decide whether the host has to be rebooted for the new system to take full effect, by comparing the system it booted
+with the new one. Both the decision and the reason for it are logged.
+*/
+func rebootNeeded(sshContext *ssh.SSHContext, host nix.Host, resultPath string, switchAction string) (bool, error) {
+	needed, reason, err := rebootReason(sshContext, host, resultPath, switchAction)
+	if err != nil {
+		return false, err
+	}
+
+	if needed {
+		events.Publish(events.Log{Host: host.Name, Message: fmt.Sprintf("Rebooting %s, since %s", host.Name, reason)})
+	} else {
+		events.Publish(events.Log{Host: host.Name, Message: fmt.Sprintf("Not rebooting %s, since %s", host.Name, reason)})
+	}
+
+	return needed, nil
+}
+
+func rebootReason(sshContext *ssh.SSHContext, host nix.Host, resultPath string, switchAction string) (bool, string, error) {
+	if switchAction != "switch" && switchAction != "boot" {
+		return false, fmt.Sprintf("'%s' doesn't make the new system the one to boot", switchAction), nil
+	}
+
+	newSystem, err := nix.GetNixSystemPath(host, resultPath)
+	if err != nil {
+		return false, "", err
+	}
+	bootedSystem, err := sshContext.ReadLink(&host, ssh.BootedSystem)
+	if err != nil {
+		return false, "", err
+	}
+	if bootedSystem == newSystem {
+		return false, "it already booted the new system", nil
+	}
+
+	booted, err := nix.GetSystemInfo(sshContext, &host, bootedSystem)
+	if err != nil {
+		return false, "", err
+	}
+	// the new system is in the local store, and on a dry run, it hasn't been pushed to the host
+	next, err := nix.GetSystemInfo(sshContext, nil, newSystem)
+	if err != nil {
+		return false, "", err
+	}
+
+	reasons := diff.CompareSystems(booted, next).RebootReasons()
+	if len(reasons) == 0 {
+		return false, "nothing loaded at boot changed", nil
+	}
+
+	return true, "something loaded at boot changed: " + strings.Join(reasons, ", "), nil
+}
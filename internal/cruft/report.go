@@ -0,0 +1,84 @@
+package cruft
+
+import (
+	"sync"
+
+	"github.com/quetzal-deploy/quetzal/internal/events"
+)
+
+// Collects the outcome of a deployment across hosts, to be reported when all hosts are done
+type deployReport struct {
+	lock      sync.Mutex
+	rollbacks []events.Rollback
+	outcomes  map[string]events.HostOutcome
+}
+
+const (
+	outcomeSucceeded  = "succeeded"
+	outcomeFailed     = "failed"
+	outcomeSkipped    = "skipped"
+	outcomeNotStarted = "not-started"
+)
+
+func (report *deployReport) addRollback(hostName string, configuration string, err error) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	report.rollbacks = append(report.rollbacks, events.Rollback{
+		Host:          hostName,
+		Configuration: configuration,
+		Error:         events.ErrorString(err),
+	})
+}
+
+func (report *deployReport) Rollbacks() []events.Rollback {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	return append([]events.Rollback{}, report.rollbacks...)
+}
+
+func (report *deployReport) addOutcome(hostName string, status string, failedStep string, err error) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	if report.outcomes == nil {
+		report.outcomes = make(map[string]events.HostOutcome)
+	}
+	report.outcomes[hostName] = events.HostOutcome{
+		Host:       hostName,
+		Status:     status,
+		FailedStep: failedStep,
+		Error:      events.ErrorString(err),
+	}
+}
+
+// The outcome of each of the hosts, in the given order. Hosts without an outcome were never started.
+func (report *deployReport) Summary(hostNames []string) []events.HostOutcome {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	summary := []events.HostOutcome{}
+	for _, hostName := range hostNames {
+		outcome, ok := report.outcomes[hostName]
+		if !ok {
+			outcome = events.HostOutcome{Host: hostName, Status: outcomeNotStarted}
+		}
+		summary = append(summary, outcome)
+	}
+
+	return summary
+}
+
+func (report *deployReport) Failed() (failed int) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	for _, outcome := range report.outcomes {
+		if outcome.Status == outcomeFailed {
+			failed++
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,147 @@
+package cruft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/healthchecks"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+// Get the configuration to roll back to if the deployment fails.
+// `boot` only changes what the host will boot into next, so the system profile is what needs restoring, while the
+// other switch-actions change the running system.
+func getRollbackConfiguration(sshContext *ssh.SSHContext, host nix.Host, switchAction string) (string, error) {
+	if switchAction == "boot" {
+		return sshContext.ReadLink(&host, ssh.SystemProfile)
+	}
+
+	return sshContext.ReadLink(&host, ssh.CurrentSystem)
+}
+
+// Switch the host back to the previous configuration using the same switch-action, and run the health checks again
+// to verify that the host is healthy after the rollback.
+func rollbackHost(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, host nix.Host, configuration string) error {
+	events.Publish(events.RollbackStarted{Host: host.Name, Configuration: configuration})
+
+	err := sshContext.ActivateConfiguration(&host, configuration, opts.DeploySwitchAction)
+
+	if err == nil && !opts.SkipHealthChecks {
+		if healthchecks.PerformHealthChecks(sshContext, &host, opts.Timeout) != nil {
+			err = errors.New("health checks failed after rollback")
+		}
+	}
+
+	events.Publish(events.RollbackFinished{Host: host.Name, Configuration: configuration, Error: events.ErrorString(err)})
+
+	return err
+}
+
+// Find the configuration to roll back to: an explicit store path, an explicit generation of the system profile, or
+// the generation before the current one
+func getRollbackTarget(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, host nix.Host) (string, error) {
+	if opts.RollbackTo != "" {
+		return opts.RollbackTo, nil
+	}
+
+	generations, err := nix.ListGenerations(sshContext, &host)
+	if err != nil {
+		return "", err
+	}
+
+	var current, previous *nix.Generation
+	for i := range generations {
+		generation := &generations[i]
+		if opts.RollbackGeneration != 0 && generation.Number == opts.RollbackGeneration {
+			return generation.Path, nil
+		}
+		if generation.Current {
+			current = generation
+		}
+	}
+
+	if opts.RollbackGeneration != 0 {
+		return "", errors.New(fmt.Sprintf("Generation %d doesn't exist on %s", opts.RollbackGeneration, host.Name))
+	}
+	if current == nil {
+		return "", errors.New(fmt.Sprintf("Couldn't find the current generation on %s", host.Name))
+	}
+	for i := range generations {
+		if generations[i].Number < current.Number {
+			previous = &generations[i]
+		}
+	}
+	if previous == nil {
+		return "", errors.New(fmt.Sprintf("There is no generation before the current generation %d on %s", current.Number, host.Name))
+	}
+
+	return previous.Path, nil
+}
+
+// Switch hosts to a previous configuration, one host at a time, stopping at the first failure
+func ExecRollback(opts *common.QuetzalOptions, hosts []nix.Host) error {
+	if opts.RollbackGeneration != 0 && opts.RollbackTo != "" {
+		return errors.New("Only one of --generation and --to can be used")
+	}
+
+	sshContext := ssh.CreateSSHContext(opts)
+
+	release, err := lockHosts(opts, sshContext, hosts, "rollback")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for _, host := range hosts {
+		if host.BuildOnly {
+			events.Publish(events.Log{Host: host.Name, Message: "Rollback is disabled for build-only host: " + host.Name})
+			continue
+		}
+
+		events.Publish(events.HostStarted{Host: host.Name})
+		start := time.Now()
+		err := rollbackTo(opts, sshContext.WithOutput(events.NewOutputWriter(host.Name)), host)
+		events.Publish(events.HostFinished{Host: host.Name, Duration: time.Since(start), Error: events.ErrorString(err)})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func rollbackTo(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, host nix.Host) error {
+	configuration, err := getRollbackTarget(opts, sshContext, host)
+	if err != nil {
+		return err
+	}
+
+	if *opts.DryRun {
+		for _, command := range sshContext.ActivationCommandLines(&host, configuration, opts.DeploySwitchAction) {
+			events.Publish(events.DryRunCommand{Host: host.Name, Step: "rollback", Command: command})
+		}
+		return nil
+	}
+
+	previousConfiguration, err := getRollbackConfiguration(sshContext, host, opts.DeploySwitchAction)
+	if err != nil {
+		return err
+	}
+
+	err = rollbackHost(opts, sshContext, host, configuration)
+	if err != nil {
+		return err
+	}
+
+	message := opts.DeployMessage
+	if message == "" {
+		message = "Rollback to " + configuration
+	}
+	recordHistory(opts, sshContext, host, configuration, opts.DeploySwitchAction, previousConfiguration, message)
+
+	return nil
+}
@@ -4,12 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/quetzal-deploy/quetzal/internal/common"
-	"github.com/quetzal-deploy/quetzal/internal/healthchecks"
+	"github.com/quetzal-deploy/quetzal/internal/events"
 	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/planner"
 	"github.com/quetzal-deploy/quetzal/internal/secrets"
 	"github.com/quetzal-deploy/quetzal/internal/ssh"
 	"github.com/quetzal-deploy/quetzal/internal/utils"
@@ -29,7 +29,7 @@ func ExecListSecrets(hosts []nix.Host) {
 }
 
 func ExecListSecretsAsJson(opts *common.QuetzalOptions, hosts []nix.Host) error {
-	deploymentDir, err := filepath.Abs(filepath.Dir(opts.Deployment))
+	deploymentDir, err := nix.DeploymentDir(opts.Deployment)
 	if err != nil {
 		return err
 	}
@@ -57,42 +57,29 @@ func ExecListSecretsAsJson(opts *common.QuetzalOptions, hosts []nix.Host) error
 	return nil
 }
 
-func ExecUploadSecrets(opts *common.QuetzalOptions, hosts []nix.Host, phase *string) error {
-	sshContext := ssh.CreateSSHContext(opts)
-
-	for _, host := range hosts {
-		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Secret upload is disabled for build-only host: %s\n", host.Name)
-			continue
-		}
-		singleHostInList := []nix.Host{host}
-
-		err := secretsUpload(opts, singleHostInList, phase)
-		if err != nil {
-			return err
-		}
-
-		if !opts.SkipHealthChecks {
-			err = healthchecks.PerformHealthChecks(sshContext, &host, opts.Timeout)
-			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not uploading to additional hosts, since a host health check failed.")
-				return err
-			}
-		}
+func ExecUploadSecrets(opts *common.QuetzalOptions, hosts []nix.Host) error {
+	plan, err := planner.PlanUploadSecrets(opts, hosts)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	_, err = runPlan(opts, ssh.CreateSSHContext(opts), plan, hosts, "upload-secrets")
+	return err
 }
 
-func secretsUpload(opts *common.QuetzalOptions, filteredHosts []nix.Host, phase *string) error {
-	sshContext := ssh.CreateSSHContext(opts)
-
+func secretsUpload(opts *common.QuetzalOptions, sshContext *ssh.SSHContext, filteredHosts []nix.Host, phase *string) error {
 	// upload secrets
 	// relative paths are resolved relative to the deployment file (!)
-	deploymentDir := filepath.Dir(opts.Deployment)
+	deploymentDir, err := nix.DeploymentDir(opts.Deployment)
+	if err != nil {
+		return err
+	}
 	for _, host := range filteredHosts {
-		fmt.Fprintf(os.Stderr, "Uploading secrets to %s (%s):\n", host.Name, host.TargetHost)
+		var phaseName string
+		if phase != nil {
+			phaseName = *phase
+		}
+		events.Publish(events.SecretsUploadStarted{Host: host.Name, TargetHost: host.TargetHost, Phase: phaseName})
 		postUploadActions := make(map[string][]string, 0)
 		for secretName, secret := range host.Secrets {
 			// if phase is nil, upload the secrets no matter what phase it wants
@@ -107,18 +94,18 @@ func secretsUpload(opts *common.QuetzalOptions, filteredHosts []nix.Host, phase
 			}
 
 			secretErr := secrets.UploadSecret(sshContext, &host, secret, deploymentDir)
-			fmt.Fprintf(os.Stderr, "\t* %s (%d bytes).. ", secretName, secretSize)
+			uploaded := events.SecretUploaded{Host: host.Name, Name: secretName, Size: secretSize, Status: "ok"}
 			if secretErr != nil {
+				uploaded.Error = secretErr.Error()
 				if secretErr.Fatal {
-					fmt.Fprintln(os.Stderr, "Failed")
+					uploaded.Status = "failed"
+					events.Publish(uploaded)
 					return secretErr
 				} else {
-					fmt.Fprintln(os.Stderr, "Partial")
-					fmt.Fprint(os.Stderr, secretErr.Error())
+					uploaded.Status = "partial"
 				}
-			} else {
-				fmt.Fprintln(os.Stderr, "OK")
 			}
+			events.Publish(uploaded)
 			if len(secret.Action) > 0 {
 				// ensure each action is only run once
 				postUploadActions[strings.Join(secret.Action, " ")] = secret.Action
@@ -126,7 +113,7 @@ func secretsUpload(opts *common.QuetzalOptions, filteredHosts []nix.Host, phase
 		}
 		// Execute post-upload secret actions one-by-one after all secrets have been uploaded
 		for _, action := range postUploadActions {
-			fmt.Fprintf(os.Stderr, "\t- executing post-upload command: "+strings.Join(action, " ")+"\n")
+			events.Publish(events.SecretActionStarted{Host: host.Name, Command: action})
 			// Errors from secret actions will be printed on screen, but we won't stop the flow if they fail
 			sshContext.CmdInteractive(&host, opts.Timeout, action...)
 		}
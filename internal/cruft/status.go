@@ -0,0 +1,123 @@
+package cruft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+const (
+	statusUpToDate      = "up-to-date"
+	statusDrifted       = "drifted"
+	statusPendingReboot = "pending-reboot"
+	statusUnreachable   = "unreachable"
+)
+
+type hostStatus struct {
+	Host           string `json:"host"`
+	Status         string `json:"status"`
+	DeclaredSystem string `json:"declaredSystem"`
+	CurrentSystem  string `json:"currentSystem,omitempty"`
+	BootedSystem   string `json:"bootedSystem,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Get the result path to compare hosts with, either by building or from the result kept by an earlier --keep-result
+func statusResultPath(opts *common.QuetzalOptions, hosts []nix.Host) (string, error) {
+	if !opts.ReuseResult {
+		return buildHosts(opts, hosts)
+	}
+
+	deploymentPath, err := nix.DeploymentPath(opts.Deployment)
+	if err != nil {
+		return "", err
+	}
+
+	resultPath, err := os.Readlink(nix.GCRootPath(deploymentPath))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("No kept result to reuse, build with --keep-result first: %s", err.Error()))
+	}
+	events.Publish(events.Log{Message: "Reusing kept result: " + resultPath})
+
+	return resultPath, nil
+}
+
+func ExecStatus(opts *common.QuetzalOptions, hosts []nix.Host) error {
+	resultPath, err := statusResultPath(opts, hosts)
+	if err != nil {
+		return err
+	}
+
+	sshContext := ssh.CreateSSHContext(opts)
+
+	statuses := []hostStatus{}
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+
+		declared, err := nix.GetNixSystemPath(host, resultPath)
+		if err != nil {
+			return errors.New(fmt.Sprintf("The result %s doesn't contain host %s: %s", resultPath, host.Name, err.Error()))
+		}
+
+		statuses = append(statuses, getHostStatus(sshContext, host, declared))
+	}
+
+	if opts.AsJson {
+		return printJson(statuses)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tCURRENT\tDECLARED")
+	for _, status := range statuses {
+		current := filepath.Base(status.CurrentSystem)
+		if status.Error != "" {
+			current = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status.Host, status.Status, current, filepath.Base(status.DeclaredSystem))
+	}
+
+	return w.Flush()
+}
+
+// Compare the system the host is running, and the one it booted, with the declared system
+func getHostStatus(sshContext *ssh.SSHContext, host nix.Host, declared string) hostStatus {
+	status := hostStatus{
+		Host:           host.Name,
+		DeclaredSystem: declared,
+	}
+
+	unreachable := func(err error) hostStatus {
+		status.Status = statusUnreachable
+		status.Error = err.Error()
+		return status
+	}
+
+	var err error
+	if status.CurrentSystem, err = sshContext.ReadLink(&host, ssh.CurrentSystem); err != nil {
+		return unreachable(err)
+	}
+	if status.BootedSystem, err = sshContext.ReadLink(&host, ssh.BootedSystem); err != nil {
+		return unreachable(err)
+	}
+
+	if status.CurrentSystem != declared {
+		status.Status = statusDrifted
+		return status
+	}
+
+	status.Status = statusUpToDate
+	if status.BootedSystem != status.CurrentSystem {
+		status.Status = statusPendingReboot
+	}
+
+	return status
+}
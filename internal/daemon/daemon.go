@@ -0,0 +1,252 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/cruft"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+	"github.com/quetzal-deploy/quetzal/internal/utils"
+)
+
+type daemon struct {
+	opts           *common.QuetzalOptions
+	deploymentPath string
+	queue          *queue
+}
+
+type apiHost struct {
+	Name       string   `json:"name"`
+	TargetHost string   `json:"targetHost"`
+	TargetPort int      `json:"targetPort,omitempty"`
+	TargetUser string   `json:"targetUser,omitempty"`
+	Tags       []string `json:"tags"`
+	BuildOnly  bool     `json:"buildOnly"`
+}
+
+/*
+Serve an HTTP API for the deployment:
+
+	GET  /hosts              hosts of the deployment
+	GET  /jobs               all jobs
+	POST /jobs               submit a job, see JobRequest
+	GET  /jobs/{id}          status of a job
+	GET  /jobs/{id}/log      human readable output of a job, streamed until the job is done
+	GET  /jobs/{id}/events   the event stream of a job as newline delimited JSON, streamed until the job is done
+*/
+func Serve(opts *common.QuetzalOptions) error {
+	deploymentPath, err := nix.DeploymentPath(opts.Deployment)
+	if err != nil {
+		return err
+	}
+
+	d := &daemon{
+		opts:           opts,
+		deploymentPath: deploymentPath,
+		queue:          newQueue(),
+	}
+	// stop running jobs along with the daemon
+	utils.AddFinalizer(d.queue.processes.stop)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /hosts", d.listHosts)
+	mux.HandleFunc("GET /jobs", d.listJobs)
+	mux.HandleFunc("POST /jobs", d.submitJob)
+	mux.HandleFunc("GET /jobs/{id}", d.getJob)
+	mux.HandleFunc("GET /jobs/{id}/log", d.followJob(func(job *Job) *streamBuffer { return job.log }, "text/plain; charset=utf-8"))
+	mux.HandleFunc("GET /jobs/{id}/events", d.followJob(func(job *Job) *streamBuffer { return job.events }, "application/x-ndjson"))
+
+	events.Publish(events.Log{Message: fmt.Sprintf("Serving %s on http://%s", opts.Deployment, opts.DaemonListen)})
+
+	return http.ListenAndServe(opts.DaemonListen, mux)
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+func (d *daemon) listHosts(w http.ResponseWriter, r *http.Request) {
+	deployment, err := nix.GetNixContext(d.opts).GetMachines(d.deploymentPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	hosts := []apiHost{}
+	for _, host := range deployment.Hosts {
+		hosts = append(hosts, apiHost{
+			Name:       host.Name,
+			TargetHost: host.TargetHost,
+			TargetPort: host.TargetPort,
+			TargetUser: host.TargetUser,
+			Tags:       host.GetTags(),
+			BuildOnly:  host.BuildOnly,
+		})
+	}
+
+	writeJson(w, http.StatusOK, hosts)
+}
+
+func (d *daemon) listJobs(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, d.queue.list())
+}
+
+func (d *daemon) getJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := d.queue.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No such job: %s", r.PathValue("id")))
+		return
+	}
+
+	writeJson(w, http.StatusOK, job)
+}
+
+func (d *daemon) submitJob(w http.ResponseWriter, r *http.Request) {
+	var request JobRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := request.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Selecting the hosts evaluates the deployment, which can take minutes, so it's done after accepting the job
+	job := d.queue.submit(request, d.jobArgs(request), func() ([]string, error) {
+		hosts, err := cruft.GetHosts(d.jobOptions(request))
+		if err != nil {
+			return nil, err
+		}
+
+		hostNames := []string{}
+		for _, host := range hosts {
+			hostNames = append(hostNames, host.Name)
+		}
+		return hostNames, nil
+	})
+	writeJson(w, http.StatusAccepted, job)
+}
+
+func (d *daemon) followJob(buffer func(job *Job) *streamBuffer, contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := d.queue.get(r.PathValue("id"))
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("No such job: %s", r.PathValue("id")))
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		flusher, _ := w.(http.Flusher)
+		buffer(&job).Follow(r.Context(), w, func() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+	}
+}
+
+// Options for selecting the hosts of a job, matching the flags passed to the job by jobArgs
+func (d *daemon) jobOptions(request JobRequest) *common.QuetzalOptions {
+	opts := *d.opts
+	opts.Deployment = d.deploymentPath
+	opts.SelectGlob = request.On
+	opts.SelectTags = request.Tagged
+	opts.SelectEvery = request.Every
+	opts.SelectSkip = request.Skip
+	opts.SelectLimit = request.Limit
+	opts.OrderingTags = request.OrderByTags
+	opts.ConstraintsFlag = &request.Constraints
+
+	return &opts
+}
+
+// Command line of the quetzal process running a job
+func (d *daemon) jobArgs(request JobRequest) []string {
+	args := []string{"--i-know-kung-fu", "--events-fd", "3"}
+	if *d.opts.KeepGCRoot {
+		args = append(args, "--keep-result")
+	}
+	if *d.opts.AllowBuildShell {
+		args = append(args, "--allow-build-shell")
+	}
+	if *d.opts.NoEvalCache {
+		args = append(args, "--no-eval-cache")
+	}
+	if *d.opts.NoUpdateLockFile {
+		args = append(args, "--no-update-lock-file")
+	}
+	if *d.opts.NoWriteLockFile {
+		args = append(args, "--no-write-lock-file")
+	}
+	inputs := []string{}
+	for input := range *d.opts.OverrideInputs {
+		inputs = append(inputs, input)
+	}
+	sort.Strings(inputs)
+	for _, input := range inputs {
+		args = append(args, "--override-input", input+"="+(*d.opts.OverrideInputs)[input])
+	}
+	for _, constraint := range request.Constraints {
+		args = append(args, "--constraint", constraint)
+	}
+
+	args = append(args, request.Command,
+		"--on", request.On,
+		"--tagged", request.Tagged,
+		"--every", strconv.Itoa(request.Every),
+		"--skip", strconv.Itoa(request.Skip),
+		"--limit", strconv.Itoa(request.Limit),
+		"--order-by-tags", request.OrderByTags,
+	)
+
+	if d.opts.ShowTrace {
+		args = append(args, "--show-trace")
+	}
+
+	if request.Command == "deploy" || request.Command == "check-health" {
+		args = append(args, "--timeout", strconv.Itoa(request.Timeout))
+	}
+
+	if request.Command == "deploy" {
+		args = append(args, "--parallel", strconv.Itoa(request.Parallel))
+		if d.opts.PassCmd != "" {
+			args = append(args, "--passcmd", d.opts.PassCmd)
+		}
+		if request.UploadSecrets {
+			args = append(args, "--upload-secrets")
+		}
+		if request.SkipHealthChecks {
+			args = append(args, "--skip-health-checks")
+		}
+		if request.RollbackOnFailure {
+			args = append(args, "--rollback-on-failure")
+		}
+		if request.Reboot != "" {
+			args = append(args, "--reboot="+request.Reboot)
+		}
+		if request.Yes {
+			args = append(args, "--yes")
+		}
+	}
+
+	args = append(args, d.deploymentPath)
+
+	if request.Command == "deploy" {
+		args = append(args, request.SwitchAction)
+	}
+
+	return args
+}
@@ -0,0 +1,368 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// What to run, as submitted through the API. Selectors work like the command line flags of the same name.
+type JobRequest struct {
+	Command      string   `json:"command"`
+	SwitchAction string   `json:"switchAction,omitempty"`
+	On           string   `json:"on,omitempty"`
+	Tagged       string   `json:"tagged,omitempty"`
+	Every        int      `json:"every,omitempty"`
+	Skip         int      `json:"skip,omitempty"`
+	Limit        int      `json:"limit,omitempty"`
+	OrderByTags  string   `json:"orderByTags,omitempty"`
+	Constraints  []string `json:"constraints,omitempty"`
+	Timeout      int      `json:"timeout,omitempty"`
+	Parallel     int      `json:"parallel,omitempty"`
+
+	// deploy only
+	UploadSecrets     bool `json:"uploadSecrets,omitempty"`
+	SkipHealthChecks  bool `json:"skipHealthChecks,omitempty"`
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
+	// "always" or "auto", like --reboot
+	Reboot string `json:"reboot,omitempty"`
+	// Jobs can't ask for confirmation, so deployments requiring it fail unless confirmed up front
+	Yes bool `json:"yes,omitempty"`
+}
+
+type Job struct {
+	ID      string     `json:"id"`
+	Request JobRequest `json:"request"`
+	// Empty until the hosts are selected, before the job starts
+	Hosts      []string   `json:"hosts"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// The JSON report of the command, see `--i-know-kung-fu`
+	Result json.RawMessage `json:"result,omitempty"`
+
+	args []string
+	// Whether the hosts of the job are still being selected
+	selecting bool
+	log       *streamBuffer
+	events    *streamBuffer
+}
+
+var (
+	switchActions = []string{"dry-activate", "test", "switch", "boot"}
+	rebootModes   = []string{"always", "auto"}
+)
+
+func (request *JobRequest) validate() error {
+	switch request.Command {
+	case "build", "push", "check-health":
+	case "deploy":
+		valid := false
+		for _, switchAction := range switchActions {
+			valid = valid || request.SwitchAction == switchAction
+		}
+		if !valid {
+			return errors.New(fmt.Sprintf("Invalid switch action %q, must be one of %v", request.SwitchAction, switchActions))
+		}
+		if request.Reboot != "" {
+			valid = false
+			for _, rebootMode := range rebootModes {
+				valid = valid || request.Reboot == rebootMode
+			}
+			if !valid {
+				return errors.New(fmt.Sprintf("Invalid reboot mode %q, must be one of %v", request.Reboot, rebootModes))
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unsupported command %q, must be one of build, push, deploy or check-health", request.Command))
+	}
+
+	if request.On == "" {
+		request.On = "*"
+	}
+	if request.Every < 1 {
+		request.Every = 1
+	}
+	if request.Parallel < 1 {
+		request.Parallel = 1
+	}
+
+	return nil
+}
+
+// Jobs changing what's on a host, which must not run at the same time as other such jobs on the same host
+func (job *Job) locksHosts() bool {
+	return job.Request.Command == "push" || job.Request.Command == "deploy"
+}
+
+// Runs jobs in the order they were submitted, holding back jobs touching hosts that are locked by a running job
+type queue struct {
+	lock sync.Mutex
+	// Selecting hosts evaluates the deployment, which is done for one job at a time
+	selectLock sync.Mutex
+	jobs       []*Job
+	byID       map[string]*Job
+	locked     map[string]string
+	nextID     int
+	processes  *processes
+}
+
+func newQueue() *queue {
+	return &queue{
+		byID:      make(map[string]*Job),
+		locked:    make(map[string]string),
+		nextID:    1,
+		processes: &processes{running: make(map[*os.Process]bool)},
+	}
+}
+
+// The processes of running jobs, so they can be stopped when the daemon exits
+type processes struct {
+	lock    sync.Mutex
+	running map[*os.Process]bool
+}
+
+func (p *processes) add(process *os.Process) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.running[process] = true
+}
+
+func (p *processes) remove(process *os.Process) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.running, process)
+}
+
+func (p *processes) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for process := range p.running {
+		_ = process.Signal(syscall.SIGTERM)
+	}
+}
+
+// Queue a job, whose hosts are selected in the background by calling selectHosts
+func (q *queue) submit(request JobRequest, args []string, selectHosts func() ([]string, error)) Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	job := &Job{
+		ID:        strconv.Itoa(q.nextID),
+		Request:   request,
+		Hosts:     []string{},
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+		args:      args,
+		selecting: true,
+		log:       newStreamBuffer(),
+		events:    newStreamBuffer(),
+	}
+	q.nextID++
+
+	q.jobs = append(q.jobs, job)
+	q.byID[job.ID] = job
+	go q.selectHosts(job, selectHosts)
+
+	return *job
+}
+
+func (q *queue) selectHosts(job *Job, selectHosts func() ([]string, error)) {
+	q.selectLock.Lock()
+	hosts, err := selectHosts()
+	q.selectLock.Unlock()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	job.selecting = false
+	if err != nil {
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Status = JobFailed
+		job.Error = err.Error()
+		fmt.Fprintln(job.log, err.Error())
+		job.log.Close()
+		job.events.Close()
+	} else {
+		job.Hosts = hosts
+	}
+
+	q.schedule()
+}
+
+// Start queued jobs whose hosts are available. Must be called with the lock held.
+func (q *queue) schedule() {
+	// hosts wanted by jobs earlier in the queue, so later jobs don't overtake them
+	wanted := make(map[string]bool)
+	// whether an earlier job touching hosts doesn't know its hosts yet, so later jobs touching hosts must wait for it
+	selecting := false
+
+	for _, job := range q.jobs {
+		if job.Status != JobQueued {
+			continue
+		}
+		if job.selecting {
+			selecting = selecting || job.locksHosts()
+			continue
+		}
+		if !job.locksHosts() {
+			q.start(job)
+			continue
+		}
+
+		available := !selecting
+		for _, host := range job.Hosts {
+			if _, ok := q.locked[host]; ok || wanted[host] {
+				available = false
+			}
+		}
+
+		if !available {
+			for _, host := range job.Hosts {
+				wanted[host] = true
+			}
+			continue
+		}
+
+		for _, host := range job.Hosts {
+			q.locked[host] = job.ID
+		}
+		q.start(job)
+	}
+}
+
+// Must be called with the lock held
+func (q *queue) start(job *Job) {
+	now := time.Now()
+	job.Status = JobRunning
+	job.StartedAt = &now
+
+	go q.run(job)
+}
+
+func (q *queue) run(job *Job) {
+	result, err := job.execute(q.processes)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Result = result
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = JobSucceeded
+	}
+
+	for host, id := range q.locked {
+		if id == job.ID {
+			delete(q.locked, host)
+		}
+	}
+
+	q.schedule()
+}
+
+// Run the job as a separate quetzal process, so jobs don't share any state. Its human readable output becomes the log
+// of the job, and its event stream is available as well.
+func (job *Job) execute(running *processes) (json.RawMessage, error) {
+	defer job.log.Close()
+	defer job.events.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	eventsReader, eventsWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer eventsReader.Close()
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(executable, job.args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = job.log
+	// becomes fd 3 in the job
+	cmd.ExtraFiles = []*os.File{eventsWriter}
+
+	err = cmd.Start()
+	eventsWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	running.add(cmd.Process)
+	defer running.remove(cmd.Process)
+
+	copied := make(chan struct{})
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := eventsReader.Read(buffer)
+			job.events.Write(buffer[:n])
+			if err != nil {
+				break
+			}
+		}
+		close(copied)
+	}()
+
+	err = cmd.Wait()
+	<-copied
+
+	var result json.RawMessage
+	if json.Valid(stdout.Bytes()) {
+		result = stdout.Bytes()
+	}
+
+	if err != nil {
+		return result, errors.New(fmt.Sprintf("Job failed: %s", err))
+	}
+
+	return result, nil
+}
+
+func (q *queue) get(id string) (Job, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	job, ok := q.byID[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func (q *queue) list() []Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	jobs := []Job{}
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// An append-only buffer which can be read while it's being written, e.g. to stream the log of a running job
+type streamBuffer struct {
+	lock    sync.Mutex
+	data    []byte
+	closed  bool
+	changed chan struct{}
+}
+
+func newStreamBuffer() *streamBuffer {
+	return &streamBuffer{changed: make(chan struct{})}
+}
+
+func (b *streamBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.data = append(b.data, p...)
+	b.notify()
+
+	return len(p), nil
+}
+
+// Mark the buffer as complete, so readers stop waiting for more data
+func (b *streamBuffer) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	b.notify()
+
+	return nil
+}
+
+func (b *streamBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *streamBuffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]byte{}, b.data...)
+}
+
+// Copy everything written to the buffer to w, until the buffer is closed or the context is cancelled.
+// flush is called whenever data has been written.
+func (b *streamBuffer) Follow(ctx context.Context, w io.Writer, flush func()) error {
+	offset := 0
+	for {
+		b.lock.Lock()
+		data := b.data[offset:]
+		closed := b.closed
+		changed := b.changed
+		b.lock.Unlock()
+
+		if len(data) > 0 {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			flush()
+			offset += len(data)
+			continue
+		}
+
+		if closed {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package diff
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// A package present in both closures, but in different versions
+type VersionChange struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	// "upgraded", "downgraded" or "changed" when there are several versions of the package and no clear direction
+	Kind string `json:"kind"`
+}
+
+// Differences between two closures. Paths that only changed hash (e.g. rebuilt with different dependencies) are only
+// reflected in the sizes.
+type ClosureDiff struct {
+	Added     []Package       `json:"added"`
+	Removed   []Package       `json:"removed"`
+	Changed   []VersionChange `json:"changed"`
+	OldSize   int64           `json:"oldSize"`
+	NewSize   int64           `json:"newSize"`
+	SizeDelta int64           `json:"sizeDelta"`
+}
+
+// Split a store path into the package name and version, e.g. /nix/store/<hash>-openssl-3.0.13 into openssl and
+// 3.0.13. Like Nix, the version starts at the first dash followed by something that isn't a letter.
+func ParseStorePath(path string) Package {
+	base := filepath.Base(path)
+	if i := strings.IndexByte(base, '-'); i >= 0 {
+		base = base[i+1:]
+	}
+
+	for i := 0; i < len(base)-1; i++ {
+		if base[i] == '-' && !unicode.IsLetter(rune(base[i+1])) {
+			return Package{Name: base[:i], Version: base[i+1:]}
+		}
+	}
+
+	return Package{Name: base}
+}
+
+// Compare closures, given as the size of each store path in them
+func CompareClosures(old map[string]int64, new map[string]int64) *ClosureDiff {
+	diff := &ClosureDiff{
+		Added:   []Package{},
+		Removed: []Package{},
+		Changed: []VersionChange{},
+	}
+
+	for _, size := range old {
+		diff.OldSize += size
+	}
+	for _, size := range new {
+		diff.NewSize += size
+	}
+	diff.SizeDelta = diff.NewSize - diff.OldSize
+
+	oldVersions := versionsByName(old)
+	newVersions := versionsByName(new)
+
+	for _, name := range sortedNames(oldVersions, newVersions) {
+		from, inOld := oldVersions[name]
+		to, inNew := newVersions[name]
+
+		switch {
+		case !inOld:
+			for _, version := range to {
+				diff.Added = append(diff.Added, Package{Name: name, Version: version})
+			}
+		case !inNew:
+			for _, version := range from {
+				diff.Removed = append(diff.Removed, Package{Name: name, Version: version})
+			}
+		case strings.Join(from, ", ") != strings.Join(to, ", "):
+			change := VersionChange{
+				Name: name,
+				From: strings.Join(from, ", "),
+				To:   strings.Join(to, ", "),
+				Kind: "changed",
+			}
+			if len(from) == 1 && len(to) == 1 {
+				if CompareVersions(from[0], to[0]) < 0 {
+					change.Kind = "upgraded"
+				} else {
+					change.Kind = "downgraded"
+				}
+			}
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+
+	return diff
+}
+
+func (diff *ClosureDiff) Empty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+}
+
+func versionsByName(paths map[string]int64) map[string][]string {
+	versions := make(map[string]map[string]bool)
+	for path := range paths {
+		pkg := ParseStorePath(path)
+		if versions[pkg.Name] == nil {
+			versions[pkg.Name] = make(map[string]bool)
+		}
+		versions[pkg.Name][pkg.Version] = true
+	}
+
+	result := make(map[string][]string)
+	for name, set := range versions {
+		for version := range set {
+			result[name] = append(result[name], version)
+		}
+		sort.Slice(result[name], func(i, j int) bool {
+			return CompareVersions(result[name][i], result[name][j]) < 0
+		})
+	}
+
+	return result
+}
+
+func sortedNames(maps ...map[string][]string) []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, m := range maps {
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (closure *ClosureDiff) Print(w io.Writer) {
+	closure.printIndented(w, "\t")
+}
+
+func (closure *ClosureDiff) printIndented(w io.Writer, indent string) {
+	for _, pkg := range closure.Added {
+		fmt.Fprintf(w, "%s+ %s %s\n", indent, pkg.Name, pkg.Version)
+	}
+	for _, pkg := range closure.Removed {
+		fmt.Fprintf(w, "%s- %s %s\n", indent, pkg.Name, pkg.Version)
+	}
+	for _, change := range closure.Changed {
+		fmt.Fprintf(w, "%s~ %s %s -> %s (%s)\n", indent, change.Name, change.From, change.To, change.Kind)
+	}
+	if closure.Empty() {
+		fmt.Fprintf(w, "%sNo package versions changed\n", indent)
+	}
+
+	sign := "+"
+	if closure.SizeDelta < 0 {
+		sign = ""
+	}
+	fmt.Fprintf(w, "%sClosure size: %s -> %s (%s%s)\n", indent, FormatSize(closure.OldSize), FormatSize(closure.NewSize), sign, FormatSize(closure.SizeDelta))
+}
+
+// Format a size in bytes for humans, e.g. 12.3 MiB
+func FormatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	value := float64(size)
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%s%d %s", sign, int64(value), units[unit])
+	}
+	return fmt.Sprintf("%s%.1f %s", sign, value, units[unit])
+}
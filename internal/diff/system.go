@@ -0,0 +1,183 @@
+package diff
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The parts of a NixOS system that matter when comparing two systems
+type SystemInfo struct {
+	Path          string `json:"path"`
+	Kernel        string `json:"kernel"`
+	Initrd        string `json:"initrd"`
+	KernelModules string `json:"kernelModules"`
+	KernelParams  string `json:"kernelParams"`
+	Systemd       string `json:"systemd"`
+	// Unit name to the unit file it links to
+	Units map[string]string `json:"units"`
+}
+
+type Change struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type UnitChanges struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+type SystemDiff struct {
+	OldSystem string `json:"oldSystem"`
+	NewSystem string `json:"newSystem"`
+	Changed   bool   `json:"changed"`
+	// Only set for the parts that changed
+	Kernel        *Change      `json:"kernel,omitempty"`
+	Initrd        *Change      `json:"initrd,omitempty"`
+	KernelModules *Change      `json:"kernelModules,omitempty"`
+	KernelParams  *Change      `json:"kernelParams,omitempty"`
+	Systemd       *Change      `json:"systemd,omitempty"`
+	Units         UnitChanges  `json:"units"`
+	Closure       *ClosureDiff `json:"closure,omitempty"`
+}
+
+func change(from string, to string) *Change {
+	if from == to {
+		return nil
+	}
+	return &Change{From: from, To: to}
+}
+
+func CompareSystems(old *SystemInfo, new *SystemInfo) *SystemDiff {
+	diff := &SystemDiff{
+		OldSystem:     old.Path,
+		NewSystem:     new.Path,
+		Changed:       old.Path != new.Path,
+		Kernel:        change(old.Kernel, new.Kernel),
+		Initrd:        change(old.Initrd, new.Initrd),
+		KernelModules: change(old.KernelModules, new.KernelModules),
+		KernelParams:  change(old.KernelParams, new.KernelParams),
+		Systemd:       change(old.Systemd, new.Systemd),
+		Units: UnitChanges{
+			Added:   []string{},
+			Removed: []string{},
+			Changed: []string{},
+		},
+	}
+
+	for name, target := range new.Units {
+		oldTarget, ok := old.Units[name]
+		if !ok {
+			diff.Units.Added = append(diff.Units.Added, name)
+		} else if oldTarget != target {
+			diff.Units.Changed = append(diff.Units.Changed, name)
+		}
+	}
+	for name := range old.Units {
+		if _, ok := new.Units[name]; !ok {
+			diff.Units.Removed = append(diff.Units.Removed, name)
+		}
+	}
+	sort.Strings(diff.Units.Added)
+	sort.Strings(diff.Units.Removed)
+	sort.Strings(diff.Units.Changed)
+
+	return diff
+}
+
+// Describe a store path by its name and version, leaving out the hash and the file within the store path
+func storeName(path string) string {
+	if !strings.HasPrefix(path, "/nix/store/") {
+		return path
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(path, "/nix/store/"), "/", 2)
+	pkg := ParseStorePath(filepath.Join("/nix/store", parts[0]))
+	if pkg.Version == "" {
+		return pkg.Name
+	}
+	return pkg.Name + " " + pkg.Version
+}
+
+func (diff *SystemDiff) Print(w io.Writer) {
+	if !diff.Changed {
+		fmt.Fprintf(w, "\tUp to date (%s)\n", diff.NewSystem)
+		return
+	}
+
+	fmt.Fprintf(w, "\tcurrent: %s\n", diff.OldSystem)
+	fmt.Fprintf(w, "\tnew:     %s\n", diff.NewSystem)
+
+	for _, part := range diff.bootParts() {
+		if part.change != nil {
+			fmt.Fprintf(w, "\t%s\n", part.describe())
+		}
+	}
+
+	if len(diff.Units.Added)+len(diff.Units.Removed)+len(diff.Units.Changed) > 0 {
+		fmt.Fprintln(w, "\tSystemd units:")
+		for _, unit := range diff.Units.Added {
+			fmt.Fprintf(w, "\t\t+ %s\n", unit)
+		}
+		for _, unit := range diff.Units.Removed {
+			fmt.Fprintf(w, "\t\t- %s\n", unit)
+		}
+		for _, unit := range diff.Units.Changed {
+			fmt.Fprintf(w, "\t\t~ %s\n", unit)
+		}
+	}
+
+	if diff.Closure != nil {
+		fmt.Fprintln(w, "\tPackages:")
+		diff.Closure.printIndented(w, "\t\t")
+	}
+}
+
+// A part of the system that is loaded at boot
+type bootPart struct {
+	what   string
+	change *Change
+	// Describe either side of the change
+	format func(string) string
+}
+
+func (diff *SystemDiff) bootParts() []bootPart {
+	quote := func(s string) string { return fmt.Sprintf("%q", s) }
+
+	return []bootPart{
+		{"Kernel", diff.Kernel, storeName},
+		{"Initrd", diff.Initrd, storeName},
+		{"Kernel modules", diff.KernelModules, storeName},
+		{"Kernel parameters", diff.KernelParams, quote},
+		{"Systemd", diff.Systemd, storeName},
+	}
+}
+
+func (part bootPart) describe() string {
+	from, to := part.format(part.change.From), part.format(part.change.To)
+	if from == to {
+		return fmt.Sprintf("%s: %s (rebuilt)", part.what, to)
+	}
+	return fmt.Sprintf("%s: %s -> %s", part.what, from, to)
+}
+
+// The changes that only take full effect after a reboot, i.e. of what is loaded at boot, e.g. "Kernel: linux 6.6.30 -> linux 6.6.31"
+func (diff *SystemDiff) RebootReasons() []string {
+	reasons := []string{}
+	for _, part := range diff.bootParts() {
+		if part.change != nil {
+			reasons = append(reasons, part.describe())
+		}
+	}
+
+	return reasons
+}
+
+// Whether the change only takes full effect after a reboot, i.e. something loaded at boot changed
+func (diff *SystemDiff) NeedsReboot() bool {
+	return len(diff.RebootReasons()) > 0
+}
@@ -0,0 +1,85 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testSystem() *SystemInfo {
+	return &SystemInfo{
+		Path:          "/nix/store/aaaa-nixos-system-web01-24.05",
+		Kernel:        "/nix/store/bbbb-linux-6.6.30/bzImage",
+		Initrd:        "/nix/store/cccc-initrd-linux-6.6.30/initrd",
+		KernelModules: "/nix/store/dddd-linux-6.6.30-modules",
+		KernelParams:  "loglevel=4",
+		Systemd:       "/nix/store/eeee-systemd-255.6",
+		Units: map[string]string{
+			"nginx.service": "/nix/store/ffff-unit-nginx.service/nginx.service",
+			"sshd.service":  "/nix/store/gggg-unit-sshd.service/sshd.service",
+		},
+	}
+}
+
+func TestRebootReasons(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(system *SystemInfo)
+		want   []string
+	}{
+		{"nothing changed", func(system *SystemInfo) {}, []string{}},
+		{"only units changed", func(system *SystemInfo) {
+			system.Path = "/nix/store/zzzz-nixos-system-web01-24.05"
+			system.Units["nginx.service"] = "/nix/store/hhhh-unit-nginx.service/nginx.service"
+		}, []string{}},
+		{"kernel updated", func(system *SystemInfo) {
+			system.Kernel = "/nix/store/iiii-linux-6.6.31/bzImage"
+			system.KernelModules = "/nix/store/jjjj-linux-6.6.31-modules"
+		}, []string{"Kernel: linux 6.6.30 -> linux 6.6.31", "Kernel modules: linux 6.6.30-modules -> linux 6.6.31-modules"}},
+		{"kernel rebuilt", func(system *SystemInfo) {
+			system.Kernel = "/nix/store/kkkk-linux-6.6.30/bzImage"
+		}, []string{"Kernel: linux 6.6.30 (rebuilt)"}},
+		{"kernel parameters", func(system *SystemInfo) {
+			system.KernelParams = "loglevel=4 quiet"
+		}, []string{`Kernel parameters: "loglevel=4" -> "loglevel=4 quiet"`}},
+		{"initrd and systemd", func(system *SystemInfo) {
+			system.Initrd = "/nix/store/llll-initrd-linux-6.6.30/initrd"
+			system.Systemd = "/nix/store/mmmm-systemd-256.1"
+		}, []string{"Initrd: initrd-linux 6.6.30 (rebuilt)", "Systemd: systemd 255.6 -> systemd 256.1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changed := testSystem()
+			test.change(changed)
+			diff := CompareSystems(testSystem(), changed)
+
+			got := diff.RebootReasons()
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("RebootReasons() = %q, want %q", got, test.want)
+			}
+			if diff.NeedsReboot() != (len(test.want) > 0) {
+				t.Errorf("NeedsReboot() = %t", diff.NeedsReboot())
+			}
+		})
+	}
+}
+
+func TestCompareSystemsUnits(t *testing.T) {
+	changed := testSystem()
+	delete(changed.Units, "sshd.service")
+	changed.Units["nginx.service"] = "/nix/store/hhhh-unit-nginx.service/nginx.service"
+	changed.Units["postgresql.service"] = "/nix/store/nnnn-unit-postgresql.service/postgresql.service"
+
+	diff := CompareSystems(testSystem(), changed)
+	want := UnitChanges{
+		Added:   []string{"postgresql.service"},
+		Removed: []string{"sshd.service"},
+		Changed: []string{"nginx.service"},
+	}
+	if !reflect.DeepEqual(diff.Units, want) {
+		t.Errorf("Units = %+v, want %+v", diff.Units, want)
+	}
+	if diff.Changed {
+		t.Error("Changed is set for the same system path")
+	}
+}
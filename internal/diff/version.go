@@ -0,0 +1,87 @@
+package diff
+
+import (
+	"strconv"
+	"unicode"
+)
+
+// Split a version into components of digits or letters, dropping separators, e.g. 1.2pre3 into 1, 2, pre and 3
+func versionComponents(version string) (components []string) {
+	for i := 0; i < len(version); {
+		c := rune(version[i])
+		if c == '.' || c == '-' {
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(version) && unicode.IsDigit(rune(version[j])) == unicode.IsDigit(c) && version[j] != '.' && version[j] != '-' {
+			j++
+		}
+		components = append(components, version[i:j])
+		i = j
+	}
+
+	return components
+}
+
+func isNumber(component string) bool {
+	_, err := strconv.Atoi(component)
+	return err == nil
+}
+
+// Compare version components the way Nix does: numbers compare numerically and are newer than anything else, and
+// "pre" is older than anything else
+func compareComponents(a string, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case isNumber(a) && isNumber(b):
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case a == "" && isNumber(b):
+		return -1
+	case isNumber(a) && b == "":
+		return 1
+	case a == "pre":
+		return -1
+	case b == "pre":
+		return 1
+	case isNumber(b):
+		return -1
+	case isNumber(a):
+		return 1
+	case a < b:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// Compare two versions like `builtins.compareVersions`, returning -1, 0 or 1
+func CompareVersions(a string, b string) int {
+	x := versionComponents(a)
+	y := versionComponents(b)
+
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var cx, cy string
+		if i < len(x) {
+			cx = x[i]
+		}
+		if i < len(y) {
+			cy = y[i]
+		}
+
+		if c := compareComponents(cx, cy); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,93 @@
+package events
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+type Event interface {
+	// Name of the event type, e.g. "check-passed"
+	EventType() string
+}
+
+// An event along with the time it was published
+type Record struct {
+	Time  time.Time
+	Event Event
+}
+
+type Subscriber interface {
+	Handle(record Record)
+}
+
+type SubscriberFunc func(record Record)
+
+func (f SubscriberFunc) Handle(record Record) {
+	f(record)
+}
+
+var (
+	subscribers []Subscriber
+	lock        sync.Mutex
+)
+
+func Subscribe(subscriber Subscriber) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	subscribers = append(subscribers, subscriber)
+}
+
+/*
+Publish an event to all subscribers.
+Events are delivered synchronously and one at a time, in the order they were published, so subscribers don't need to
+do their own locking. Subscribers must not publish events themselves, and those doing slow I/O should be wrapped in a
+QueuedSubscriber.
+*/
+func Publish(event Event) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	record := Record{
+		Time:  time.Now(),
+		Event: event,
+	}
+
+	for _, subscriber := range subscribers {
+		subscriber.Handle(record)
+	}
+}
+
+// Convert an error to a string suitable for an event, where no error is an empty string
+func ErrorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// A writer publishing everything written to it as Output events, e.g. for the output of commands
+type OutputWriter struct {
+	host string
+}
+
+func NewOutputWriter(host string) *OutputWriter {
+	return &OutputWriter{host: host}
+}
+
+// Each line becomes a separate event. Partial lines are published as they are, since commands may print progress
+// without a trailing newline.
+func (w *OutputWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		Publish(Output{Host: w.host, Text: string(line)})
+		p = p[len(line):]
+	}
+
+	return n, nil
+}
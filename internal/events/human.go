@@ -0,0 +1,225 @@
+package events
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Renders events as human readable text, e.g. to stderr
+type HumanSubscriber struct {
+	w io.Writer
+	// Buffer the output of each host until it's done, to avoid mixing output from hosts handled in parallel
+	buffered bool
+	buffers  map[string]*bytes.Buffer
+}
+
+func NewHumanSubscriber(w io.Writer, buffered bool) *HumanSubscriber {
+	return &HumanSubscriber{
+		w:        w,
+		buffered: buffered,
+		buffers:  make(map[string]*bytes.Buffer),
+	}
+}
+
+func (s *HumanSubscriber) Handle(record Record) {
+	switch e := record.Event.(type) {
+	case HostStarted:
+		if s.buffered {
+			fmt.Fprintf(s.w, "Started: %s\n", e.Host)
+			s.buffers[e.Host] = &bytes.Buffer{}
+		}
+		return
+
+	case HostFinished:
+		if buffer, ok := s.buffers[e.Host]; ok {
+			fmt.Fprintf(s.w, "\n==> %s\n", e.Host)
+			s.w.Write(buffer.Bytes())
+			delete(s.buffers, e.Host)
+		}
+		if e.Error != "" {
+			if s.buffered {
+				fmt.Fprintf(s.w, "Failed: %s: %s\n", e.Host, e.Error)
+			}
+		} else {
+			fmt.Fprintln(s.w, "Done:", e.Host)
+		}
+		return
+	}
+
+	w := s.w
+	if buffer, ok := s.buffers[HostOf(record.Event)]; ok {
+		w = buffer
+	}
+
+	Render(w, record.Event)
+}
+
+// Write the human readable representation of an event. Some events have no representation.
+func Render(w io.Writer, event Event) {
+	switch e := event.(type) {
+	case Log:
+		fmt.Fprintln(w, e.Message)
+
+	case Output:
+		fmt.Fprint(w, e.Text)
+
+	case HostsSelected:
+		fmt.Fprintf(w, "Selected %v/%v hosts (name filter:-%v, limits:-%v):\n", len(e.Hosts), e.Total, e.NameFiltered, e.Limited)
+		for index, host := range e.Hosts {
+			fmt.Fprintf(w, "\t%3d: %s (secrets: %d, health checks: %d, tags: %s)\n", index, host.Name, host.Secrets, host.HealthChecks, strings.Join(host.Tags, ","))
+		}
+		fmt.Fprintln(w)
+
+	case BuildFinished:
+		if e.Error == "" {
+			fmt.Fprintln(w, "nix result path: ")
+		}
+
+	case RunFinished:
+		if len(e.RolledBack) > 0 {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "Rolled back hosts:")
+			for _, r := range e.RolledBack {
+				if r.Error != "" {
+					fmt.Fprintf(w, "\t* %s -> %s: Failed (%s)\n", r.Host, r.Configuration, r.Error)
+				} else {
+					fmt.Fprintf(w, "\t* %s -> %s: OK\n", r.Host, r.Configuration)
+				}
+			}
+		}
+
+		if len(e.Summary) > 0 {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "Summary:")
+			table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(table, "\tHOST\tOUTCOME\tFAILED STEP\tERROR")
+			for _, outcome := range e.Summary {
+				// only the first line of the error, the rest has been shown already
+				message, _, _ := strings.Cut(outcome.Error, "\n")
+				fmt.Fprintf(table, "\t%s\t%s\t%s\t%s\n", outcome.Host, outcome.Status, outcome.FailedStep, message)
+			}
+			table.Flush()
+		}
+
+	case HostSkipped:
+		fmt.Fprintf(w, "%s: %s\n", e.Reason, e.Host)
+
+	case StepFinished:
+		// separate the output of the bigger steps
+		if e.Error == "" && (e.StepType == "build" || e.StepType == "push" || e.StepType == "upload-secrets") {
+			fmt.Fprintln(w)
+		}
+
+	case PushStarted:
+		target := e.TargetHost
+		if e.TargetUser != "" {
+			target = e.TargetUser + "@" + target
+		}
+		fmt.Fprintf(w, "Pushing paths to %v (%v):\n", e.Host, target)
+		for _, path := range e.Paths {
+			fmt.Fprintf(w, "\t* %s\n", path)
+		}
+
+	case SecretsUploadStarted:
+		fmt.Fprintf(w, "Uploading secrets to %s (%s):\n", e.Host, e.TargetHost)
+
+	case SecretUploaded:
+		fmt.Fprintf(w, "\t* %s (%d bytes).. ", e.Name, e.Size)
+		switch e.Status {
+		case "ok":
+			fmt.Fprintln(w, "OK")
+		case "partial":
+			fmt.Fprintln(w, "Partial")
+			fmt.Fprint(w, e.Error)
+		default:
+			fmt.Fprintln(w, "Failed")
+		}
+
+	case SecretActionStarted:
+		fmt.Fprintf(w, "\t- executing post-upload command: %s\n", strings.Join(e.Command, " "))
+
+	case ChecksStarted:
+		fmt.Fprintf(w, "Running %s on %s (%s):\n", e.Kind, e.Host, e.TargetHost)
+
+	case CheckPassed:
+		fmt.Fprintf(w, "\t* %s: OK\n", e.Description)
+
+	case CheckFailed:
+		fmt.Fprintf(w, "\t* %s: Failed (%s)\n", e.Description, e.Error)
+
+	case ChecksFinished:
+		if e.Error == "" {
+			fmt.Fprintln(w, e.Kind+" OK")
+		} else if e.Timeout > 0 {
+			fmt.Fprintf(w, "Timeout: Gave up waiting for %s to complete after %d seconds\n", e.Kind, e.Timeout)
+		} else {
+			fmt.Fprintf(w, "%s failed: %s\n", e.Kind, e.Error)
+		}
+
+	case ActivationStarted:
+		fmt.Fprintf(w, "Executing '%s' on %s:\n", e.SwitchAction, e.Host)
+
+	case ActivationFinished:
+		if e.Error == "" {
+			fmt.Fprintln(w)
+		}
+
+	case HostChanges:
+		if !e.WouldChange {
+			fmt.Fprintf(w, "No changes on %s, it's already running %s\n", e.Host, e.NewSystem)
+			break
+		}
+		fmt.Fprintf(w, "Changes on %s:\n", e.Host)
+		fmt.Fprintf(w, "\tcurrent: %s\n", e.CurrentSystem)
+		fmt.Fprintf(w, "\tnew:     %s\n", e.NewSystem)
+		if e.Closure != nil {
+			e.Closure.Print(w)
+		}
+
+	case DryRunCommand:
+		fmt.Fprintf(w, "Would run: %s\n", e.Command)
+
+	case RollbackStarted:
+		fmt.Fprintf(w, "Rolling back %s to %s\n", e.Host, e.Configuration)
+
+	case RollbackFinished:
+		if e.Error == "" {
+			fmt.Fprintf(w, "Rolled back: %s\n", e.Host)
+		} else {
+			fmt.Fprintf(w, "Rollback of %s failed: %s\n", e.Host, e.Error)
+		}
+
+	case RebootStarted:
+		fmt.Fprint(w, "Asking host to reboot ... ")
+
+	case RebootRequested:
+		if e.Error != "" {
+			fmt.Fprintln(w, "Failed")
+		} else {
+			if e.Disconnected {
+				fmt.Fprintln(w, "Remote host disconnected.")
+			}
+			fmt.Fprintln(w, "OK")
+		}
+
+	case RebootWaiting:
+		if e.Attempt == 1 {
+			fmt.Fprint(w, "Waiting for host to come online ")
+		}
+		fmt.Fprint(w, ".")
+
+	case RebootDetected:
+		fmt.Fprint(w, "[new boot ID]")
+
+	case RebootPhaseReached:
+		if e.Phase == "booted" {
+			fmt.Fprintln(w, " OK")
+		} else if e.Phase != "rebooted" {
+			// the new boot ID is shown by RebootDetected
+			fmt.Fprintf(w, "[%s]", e.Description)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Writes every event as a line of JSON, e.g. `{"time":"...","type":"check-passed","host":"web01",...}`
+type JSONSubscriber struct {
+	w io.Writer
+}
+
+func NewJSONSubscriber(w io.Writer) *JSONSubscriber {
+	return &JSONSubscriber{w: w}
+}
+
+func (s *JSONSubscriber) Handle(record Record) {
+	line, err := MarshalRecord(record)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to serialize %s event: %s\n", record.Event.EventType(), err)
+		return
+	}
+
+	fmt.Fprintf(s.w, "%s\n", line)
+}
+
+// Serialize an event as a flat JSON object, with the time and type of the event added to its fields
+func MarshalRecord(record Record) ([]byte, error) {
+	data, err := json.Marshal(record.Event)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{})
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	fields["time"] = record.Time.Format(time.RFC3339Nano)
+	fields["type"] = record.Event.EventType()
+
+	return json.Marshal(fields)
+}
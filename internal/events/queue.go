@@ -0,0 +1,65 @@
+package events
+
+// Events waiting for a queued subscriber before publishing blocks
+const queueSize = 10000
+
+type queued struct {
+	record Record
+	// Closed once everything before it is handled, instead of handling a record
+	flushed chan struct{}
+}
+
+/*
+A subscriber handing events to another subscriber on its own goroutine, for subscribers doing slow I/O, e.g. writing to
+a pipe or a file. Publishing only waits for them when the queue is full, so a slow subscriber doesn't hold up the hosts
+handled in parallel. Events are still handled one at a time, in the order they were published.
+*/
+type QueuedSubscriber struct {
+	subscriber Subscriber
+	queue      chan queued
+}
+
+func NewQueuedSubscriber(subscriber Subscriber) *QueuedSubscriber {
+	s := &QueuedSubscriber{
+		subscriber: subscriber,
+		queue:      make(chan queued, queueSize),
+	}
+	go s.deliver()
+
+	return s
+}
+
+func (s *QueuedSubscriber) Handle(record Record) {
+	s.queue <- queued{record: record}
+}
+
+func (s *QueuedSubscriber) deliver() {
+	for item := range s.queue {
+		if item.flushed != nil {
+			close(item.flushed)
+			continue
+		}
+		s.subscriber.Handle(item.record)
+	}
+}
+
+/*
+Wait until queued subscribers have handled the events published so far, e.g. before asking the user something, or
+before exiting, so nothing is missing from what's written.
+*/
+func Flush() {
+	lock.Lock()
+	var waiting []chan struct{}
+	for _, subscriber := range subscribers {
+		if s, ok := subscriber.(*QueuedSubscriber); ok {
+			flushed := make(chan struct{})
+			s.queue <- queued{flushed: flushed}
+			waiting = append(waiting, flushed)
+		}
+	}
+	lock.Unlock()
+
+	for _, flushed := range waiting {
+		<-flushed
+	}
+}
@@ -0,0 +1,288 @@
+package events
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/diff"
+)
+
+// Errors are stored as strings in events, to make them serializable. An empty string means no error.
+
+// Free-form message, for things that don't warrant a separate event type
+type Log struct {
+	Host    string `json:"host,omitempty"`
+	Message string `json:"message"`
+}
+
+// Output from commands executed locally or on a host
+type Output struct {
+	Host string `json:"host,omitempty"`
+	Text string `json:"text"`
+}
+
+type SelectedHost struct {
+	Name         string   `json:"name"`
+	Secrets      int      `json:"secrets"`
+	HealthChecks int      `json:"healthChecks"`
+	Tags         []string `json:"tags"`
+}
+
+type HostsSelected struct {
+	Total        int            `json:"total"`
+	NameFiltered int            `json:"nameFiltered"`
+	Limited      int            `json:"limited"`
+	Hosts        []SelectedHost `json:"hosts"`
+}
+
+type BuildStarted struct {
+	Hosts []string `json:"hosts"`
+}
+
+type BuildFinished struct {
+	ResultPath string `json:"resultPath,omitempty"`
+	// Store path of the system configuration of each host
+	Paths map[string]string `json:"paths,omitempty"`
+	Error string            `json:"error,omitempty"`
+}
+
+// The value of an attribute inspected with `quetzal eval`
+type Evaluated struct {
+	Attribute string `json:"attribute"`
+	Value     string `json:"value"`
+}
+
+type Rollback struct {
+	Host          string `json:"host"`
+	Configuration string `json:"configuration"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Outcome of a single host at the end of a run
+type HostOutcome struct {
+	Host string `json:"host"`
+	// "succeeded", "failed", "skipped" or "not-started" when the host had to wait for a failed host
+	Status     string `json:"status"`
+	FailedStep string `json:"failedStep,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type RunStarted struct {
+	Command      string   `json:"command"`
+	SwitchAction string   `json:"switchAction,omitempty"`
+	Hosts        []string `json:"hosts"`
+}
+
+type RunFinished struct {
+	Command    string     `json:"command"`
+	Error      string     `json:"error,omitempty"`
+	RolledBack []Rollback `json:"rolledBack,omitempty"`
+	// Only set when the run continued past failing hosts
+	Summary []HostOutcome `json:"summary,omitempty"`
+}
+
+type HostStarted struct {
+	Host string `json:"host"`
+}
+
+type HostFinished struct {
+	Host     string        `json:"host"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type HostSkipped struct {
+	Host   string `json:"host"`
+	Reason string `json:"reason"`
+}
+
+type StepStarted struct {
+	Host     string `json:"host,omitempty"`
+	Step     string `json:"step"`
+	StepType string `json:"stepType"`
+}
+
+type StepFinished struct {
+	Host     string        `json:"host,omitempty"`
+	Step     string        `json:"step"`
+	StepType string        `json:"stepType"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type PushStarted struct {
+	Host       string   `json:"host"`
+	TargetUser string   `json:"targetUser,omitempty"`
+	TargetHost string   `json:"targetHost"`
+	Paths      []string `json:"paths"`
+}
+
+type PushFinished struct {
+	Host  string `json:"host"`
+	Error string `json:"error,omitempty"`
+}
+
+type SecretsUploadStarted struct {
+	Host       string `json:"host"`
+	TargetHost string `json:"targetHost"`
+	Phase      string `json:"phase,omitempty"`
+}
+
+type SecretUploaded struct {
+	Host string `json:"host"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// One of "ok", "partial" (uploaded, but owner or permissions couldn't be set) or "failed"
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type SecretActionStarted struct {
+	Host    string   `json:"host"`
+	Command []string `json:"command"`
+}
+
+type ChecksStarted struct {
+	Host       string `json:"host"`
+	TargetHost string `json:"targetHost"`
+	// "pre-deploy checks" or "health checks"
+	Kind string `json:"kind"`
+}
+
+type CheckPassed struct {
+	Host        string `json:"host"`
+	Kind        string `json:"kind"`
+	Description string `json:"description"`
+}
+
+type CheckFailed struct {
+	Host        string `json:"host"`
+	Kind        string `json:"kind"`
+	Description string `json:"description"`
+	Error       string `json:"error"`
+}
+
+type ChecksFinished struct {
+	Host    string `json:"host"`
+	Kind    string `json:"kind"`
+	Timeout int    `json:"timeout,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ActivationStarted struct {
+	Host          string `json:"host"`
+	SwitchAction  string `json:"switchAction"`
+	Configuration string `json:"configuration"`
+}
+
+type ActivationFinished struct {
+	Host          string `json:"host"`
+	SwitchAction  string `json:"switchAction"`
+	Configuration string `json:"configuration"`
+	Error         string `json:"error,omitempty"`
+}
+
+// What activating the new configuration would change on a host
+type HostChanges struct {
+	Host          string            `json:"host"`
+	CurrentSystem string            `json:"currentSystem"`
+	NewSystem     string            `json:"newSystem"`
+	WouldChange   bool              `json:"wouldChange"`
+	Closure       *diff.ClosureDiff `json:"closure,omitempty"`
+}
+
+// A command that would have been executed, if not for --dry-run
+type DryRunCommand struct {
+	Host    string `json:"host"`
+	Step    string `json:"step"`
+	Command string `json:"command"`
+}
+
+type RollbackStarted struct {
+	Host          string `json:"host"`
+	Configuration string `json:"configuration"`
+}
+
+type RollbackFinished struct {
+	Host          string `json:"host"`
+	Configuration string `json:"configuration"`
+	Error         string `json:"error,omitempty"`
+}
+
+type RebootStarted struct {
+	Host string `json:"host"`
+}
+
+// The host has been asked to reboot
+type RebootRequested struct {
+	Host         string `json:"host"`
+	Disconnected bool   `json:"disconnected"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Published for every attempt at checking whether the host is back online
+type RebootWaiting struct {
+	Host    string `json:"host"`
+	Attempt int    `json:"attempt"`
+}
+
+type RebootDetected struct {
+	Host      string `json:"host"`
+	OldBootID string `json:"oldBootId"`
+	NewBootID string `json:"newBootId"`
+}
+
+// The host has reached the next phase of coming back from a reboot, see nix.RebootPhase
+type RebootPhaseReached struct {
+	Host        string `json:"host"`
+	Phase       string `json:"phase"`
+	Description string `json:"description"`
+}
+
+func (Log) EventType() string                  { return "log" }
+func (Output) EventType() string               { return "output" }
+func (HostsSelected) EventType() string        { return "hosts-selected" }
+func (BuildStarted) EventType() string         { return "build-started" }
+func (BuildFinished) EventType() string        { return "build-finished" }
+func (Evaluated) EventType() string            { return "evaluated" }
+func (RunStarted) EventType() string           { return "run-started" }
+func (RunFinished) EventType() string          { return "run-finished" }
+func (HostStarted) EventType() string          { return "host-started" }
+func (HostFinished) EventType() string         { return "host-finished" }
+func (HostSkipped) EventType() string          { return "host-skipped" }
+func (StepStarted) EventType() string          { return "step-started" }
+func (StepFinished) EventType() string         { return "step-finished" }
+func (PushStarted) EventType() string          { return "push-started" }
+func (PushFinished) EventType() string         { return "push-finished" }
+func (SecretsUploadStarted) EventType() string { return "secrets-upload-started" }
+func (SecretUploaded) EventType() string       { return "secret-uploaded" }
+func (SecretActionStarted) EventType() string  { return "secret-action-started" }
+func (ChecksStarted) EventType() string        { return "checks-started" }
+func (CheckPassed) EventType() string          { return "check-passed" }
+func (CheckFailed) EventType() string          { return "check-failed" }
+func (ChecksFinished) EventType() string       { return "checks-finished" }
+func (ActivationStarted) EventType() string    { return "activation-started" }
+func (ActivationFinished) EventType() string   { return "activation-finished" }
+func (HostChanges) EventType() string          { return "host-changes" }
+func (DryRunCommand) EventType() string        { return "dry-run-command" }
+func (RollbackStarted) EventType() string      { return "rollback-started" }
+func (RollbackFinished) EventType() string     { return "rollback-finished" }
+func (RebootStarted) EventType() string        { return "reboot-started" }
+func (RebootRequested) EventType() string      { return "reboot-requested" }
+func (RebootWaiting) EventType() string        { return "reboot-waiting" }
+func (RebootDetected) EventType() string       { return "reboot-detected" }
+func (RebootPhaseReached) EventType() string   { return "reboot-phase-reached" }
+
+// The host an event relates to, or an empty string for events that aren't tied to a host
+func HostOf(event Event) string {
+	v := reflect.ValueOf(event)
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+
+	if field := v.FieldByName("Host"); field.IsValid() && field.Kind() == reflect.String {
+		return field.String()
+	}
+
+	return ""
+}
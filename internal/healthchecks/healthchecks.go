@@ -3,25 +3,25 @@ package healthchecks
 import (
 	"errors"
 	"fmt"
-	"os"
 	"sync"
 	"time"
 
+	"github.com/quetzal-deploy/quetzal/internal/events"
 	"github.com/quetzal-deploy/quetzal/internal/ssh"
 )
 
 func PerformChecks(sshContext *ssh.SSHContext, checkName string, host Host, healthChecks HealthChecks, timeout int) (err error) {
-	fmt.Fprintf(os.Stderr, "Running %s on %s (%s):\n", checkName, host.GetName(), host.GetTargetHost())
+	events.Publish(events.ChecksStarted{Host: host.GetName(), TargetHost: host.GetTargetHost(), Kind: checkName})
 
 	wg := sync.WaitGroup{}
 	for _, healthCheck := range healthChecks.Cmd {
 		wg.Add(1)
 		healthCheck.SshContext = sshContext
-		go runCheckUntilSuccess(host, healthCheck, &wg)
+		go runCheckUntilSuccess(checkName, host, healthCheck, &wg)
 	}
 	for _, healthCheck := range healthChecks.Http {
 		wg.Add(1)
-		go runCheckUntilSuccess(host, healthCheck, &wg)
+		go runCheckUntilSuccess(checkName, host, healthCheck, &wg)
 	}
 
 	doneChan := make(chan bool)
@@ -45,11 +45,12 @@ func PerformChecks(sshContext *ssh.SSHContext, checkName string, host Host, heal
 	for !done {
 		select {
 		case <-doneChan:
-			fmt.Fprintln(os.Stderr, checkName+" OK")
+			events.Publish(events.ChecksFinished{Host: host.GetName(), Kind: checkName})
 			done = true
 		case <-timeoutChan:
-			fmt.Fprintf(os.Stderr, "Timeout: Gave up waiting for %s to complete after %d seconds\n", checkName, timeout)
-			return errors.New(fmt.Sprintf("timeout running %s on %s", checkName, host.GetName()))
+			err = errors.New(fmt.Sprintf("timeout running %s on %s", checkName, host.GetName()))
+			events.Publish(events.ChecksFinished{Host: host.GetName(), Kind: checkName, Timeout: timeout, Error: err.Error()})
+			return err
 		}
 	}
 
@@ -64,14 +65,14 @@ func PerformHealthChecks(sshContext *ssh.SSHContext, host Host, timeout int) (er
 	return PerformChecks(sshContext, "health checks", host, host.GetHealthChecks(), timeout)
 }
 
-func runCheckUntilSuccess(host Host, healthCheck HealthCheck, wg *sync.WaitGroup) {
+func runCheckUntilSuccess(checkName string, host Host, healthCheck HealthCheck, wg *sync.WaitGroup) {
 	for {
 		err := healthCheck.Run(host)
 		if err == nil {
-			fmt.Fprintf(os.Stderr, "\t* %s: OK\n", healthCheck.GetDescription())
+			events.Publish(events.CheckPassed{Host: host.GetName(), Kind: checkName, Description: healthCheck.GetDescription()})
 			break
 		} else {
-			fmt.Fprintf(os.Stderr, "\t* %s: Failed (%s)\n", healthCheck.GetDescription(), err)
+			events.Publish(events.CheckFailed{Host: host.GetName(), Kind: checkName, Description: healthCheck.GetDescription(), Error: err.Error()})
 			time.Sleep(time.Duration(healthCheck.GetPeriod()) * time.Second)
 		}
 	}
@@ -0,0 +1,151 @@
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+	"github.com/quetzal-deploy/quetzal/internal/utils"
+)
+
+// Newline delimited JSON records, one for each activation, readable by anyone on the host
+var historyFile = filepath.Join(ssh.StateDir, "history.jsonl")
+
+// A deployment to a host
+type Record struct {
+	Time           time.Time `json:"time"`
+	User           string    `json:"user"`
+	Machine        string    `json:"machine"`
+	SwitchAction   string    `json:"switchAction"`
+	System         string    `json:"system"`
+	PreviousSystem string    `json:"previousSystem"`
+	Deployment     string    `json:"deployment"`
+	// Revision of the git repository containing the deployment, with a "-dirty" suffix if there are uncommitted changes
+	GitRevision string `json:"gitRevision,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// Describe a deployment done by whoever runs this command
+func NewRecord(deployment string, switchAction string, system string, previousSystem string, message string) Record {
+	record := Record{
+		Time:           time.Now(),
+		SwitchAction:   switchAction,
+		System:         system,
+		PreviousSystem: previousSystem,
+		Deployment:     deployment,
+		GitRevision:    gitRevision(filepath.Dir(deployment)),
+		Message:        message,
+	}
+	record.User, record.Machine = utils.Operator()
+
+	return record
+}
+
+// The revision checked out in the git repository containing dir, or nothing if it's not in a git repository
+func gitRevision(dir string) string {
+	revision, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+
+	result := strings.TrimSpace(string(revision))
+	if status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output(); err == nil && len(bytes.TrimSpace(status)) > 0 {
+		result += "-dirty"
+	}
+
+	return result
+}
+
+func run(cmd *exec.Cmd, host ssh.Host, what string) (string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error on remote host %s (%s):\nCouldn't %s %s\n\nOriginal error:\n%s",
+			host.GetName(), host.GetTargetHost(), what, historyFile, stderr.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	return stdout.String(), nil
+}
+
+// Append a record to the history on the host
+func Append(sshContext *ssh.SSHContext, host ssh.Host, record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(`mkdir -p %s && printf '%%s\n' %s >> %s && chmod 644 %s`,
+		ssh.StateDir, utils.ShellJoin(string(data)), historyFile, historyFile)
+
+	cmd, err := sshContext.SudoCmd(host, "sh", "-c", utils.ShellJoin(script))
+	if err != nil {
+		return err
+	}
+
+	_, err = run(cmd, host, "append to")
+	return err
+}
+
+// Read the history of the host, oldest record first
+func Read(sshContext *ssh.SSHContext, host ssh.Host) ([]Record, error) {
+	script := fmt.Sprintf(`if [ -e %s ]; then cat %s; fi`, historyFile, historyFile)
+
+	cmd, err := sshContext.Cmd(host, "sh", "-c", utils.ShellJoin(script))
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := run(cmd, host, "read")
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid record in %s on %s: %s", historyFile, host.GetName(), err.Error()))
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Show the records as a timeline, most recent first
+func Print(w io.Writer, records []Record) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "\tNo deployments recorded")
+		return
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		fmt.Fprintf(w, "\t%s  %-12s %s@%s", record.Time.Local().Format(time.DateTime), record.SwitchAction, record.User, record.Machine)
+		if record.GitRevision != "" {
+			fmt.Fprintf(w, "  git %s", record.GitRevision)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "\t\t%s\n", record.System)
+		if record.Message != "" {
+			fmt.Fprintf(w, "\t\t%q\n", record.Message)
+		}
+	}
+}
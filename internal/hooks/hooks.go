@@ -0,0 +1,87 @@
+package hooks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/utils"
+)
+
+// When hooks are run, relative to the deployment of a host
+const (
+	PreDeploy       = "preDeploy"
+	PostActivate    = "postActivate"
+	PostHealthCheck = "postHealthCheck"
+	OnFailure       = "onFailure"
+)
+
+// What happens when a hook fails
+const (
+	// Fail the deployment of the host
+	PolicyAbort = "abort"
+	// Log the failure and carry on
+	PolicyContinue = "continue"
+)
+
+// A command run on the deploying machine
+type Hook struct {
+	Cmd           []string
+	FailurePolicy string
+}
+
+type Hooks struct {
+	PreDeploy       []Hook
+	PostActivate    []Hook
+	PostHealthCheck []Hook
+	OnFailure       []Hook
+}
+
+func (hooks Hooks) ForPhase(phase string) []Hook {
+	switch phase {
+	case PreDeploy:
+		return hooks.PreDeploy
+	case PostActivate:
+		return hooks.PostActivate
+	case PostHealthCheck:
+		return hooks.PostHealthCheck
+	case OnFailure:
+		return hooks.OnFailure
+	}
+	return nil
+}
+
+// Run the hooks of a phase in order, in dir and with env added to the environment of Quetzal.
+// The first hook failing with the abort policy stops the remaining hooks.
+func Run(host string, phase string, hooks []Hook, dir string, env []string, output io.Writer) error {
+	for _, hook := range hooks {
+		if len(hook.Cmd) == 0 {
+			continue
+		}
+
+		events.Publish(events.Log{Host: host, Message: fmt.Sprintf("Running %s hook for %s: %s", phase, host, utils.ShellJoin(hook.Cmd...))})
+
+		cmd := exec.Command(hook.Cmd[0], hook.Cmd[1:]...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = output
+		cmd.Stderr = output
+
+		err := cmd.Run()
+		if err == nil {
+			continue
+		}
+
+		err = errors.New(fmt.Sprintf("%s hook `%s` failed: %s", phase, utils.ShellJoin(hook.Cmd...), err.Error()))
+		if hook.FailurePolicy == PolicyContinue {
+			events.Publish(events.Log{Host: host, Message: "Warning: " + err.Error()})
+			continue
+		}
+		return err
+	}
+
+	return nil
+}
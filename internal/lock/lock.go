@@ -0,0 +1,210 @@
+package lock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+	"github.com/quetzal-deploy/quetzal/internal/utils"
+)
+
+// The lock is a directory, since creating one is atomic, holding a file describing the holder
+var lockDir = filepath.Join(ssh.StateDir, "lock")
+
+// Who holds a lock on a host
+type Holder struct {
+	User    string    `json:"user"`
+	Machine string    `json:"machine"`
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	// Identifies the holder when releasing the lock, so a lock taken over by someone else isn't released
+	Token string `json:"token"`
+}
+
+func (holder *Holder) String() string {
+	if holder.User == "" && holder.Machine == "" {
+		return "an unknown holder"
+	}
+	return fmt.Sprintf("%s@%s since %s (%s)", holder.User, holder.Machine, holder.Time.Local().Format(time.DateTime), holder.Command)
+}
+
+type Lock struct {
+	sshContext *ssh.SSHContext
+	host       ssh.Host
+	holder     Holder
+	// Closed on release, stopping the heartbeat
+	done chan struct{}
+}
+
+// Describe whoever runs this command, for locking hosts
+func NewHolder(command string) (Holder, error) {
+	holder := Holder{
+		Time:    time.Now(),
+		Command: command,
+	}
+
+	holder.User, holder.Machine = utils.Operator()
+
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return holder, err
+	}
+	holder.Token = hex.EncodeToString(token)
+
+	return holder, nil
+}
+
+func parseHolder(data string) *Holder {
+	holder := &Holder{}
+	// a lock without a (valid) holder was most likely just taken, and the holder not written yet
+	_ = json.Unmarshal([]byte(data), holder)
+	return holder
+}
+
+func (lock *Lock) run(script string) (string, error) {
+	cmd, err := lock.sshContext.SudoCmd(lock.host, "sh", "-c", utils.ShellJoin(script))
+	if err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error on remote host %s (%s):\nCouldn't access the deploy lock %s\n\nOriginal error:\n%s",
+			lock.host.GetName(), lock.host.GetTargetHost(), lockDir, stderr.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	return stdout.String(), nil
+}
+
+// Take the deploy lock on a host. Locks older than expiry are considered stale and taken over, and with force the
+// lock is taken over no matter who holds it.
+func Acquire(sshContext *ssh.SSHContext, host ssh.Host, holder Holder, expiry time.Duration, force bool) (*Lock, error) {
+	lock := &Lock{sshContext: sshContext, host: host, holder: holder, done: make(chan struct{})}
+
+	holderJson, err := json.Marshal(holder)
+	if err != nil {
+		return nil, err
+	}
+
+	forceFlag := 0
+	if force {
+		forceFlag = 1
+	}
+
+	// the age of a lock is measured using the clock of the host, so it's not affected by clock skew
+	script := fmt.Sprintf(`dir=%s
+mkdir -p "$(dirname "$dir")"
+if [ -d "$dir" ]; then
+	age=$(( $(date +%%s) - $(stat -c %%Y "$dir") ))
+	if [ %d = 1 ] || [ "$age" -ge %d ]; then
+		echo "removed $(cat "$dir/holder" 2>/dev/null)"
+		rm -rf "$dir"
+	fi
+fi
+if mkdir "$dir" 2>/dev/null; then
+	printf '%%s\n' %s > "$dir/holder"
+	echo acquired
+else
+	echo "held $(cat "$dir/holder" 2>/dev/null)"
+fi`, lockDir, forceFlag, int(expiry.Seconds()), utils.ShellJoin(string(holderJson)))
+
+	output, err := lock.run(script)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		status, data, _ := strings.Cut(line, " ")
+		switch status {
+		case "removed":
+			message := "Removed stale lock on %s held by %s"
+			if force {
+				message = "Forcefully removed lock on %s held by %s"
+			}
+			events.Publish(events.Log{Host: host.GetName(), Message: fmt.Sprintf(message, host.GetName(), parseHolder(data))})
+		case "held":
+			errorMessage := fmt.Sprintf(
+				"Host %s is locked by %s. Wait for it to finish, or use --force-unlock if the lock is left over",
+				host.GetName(), parseHolder(data),
+			)
+			return nil, errors.New(errorMessage)
+		case "acquired":
+			go lock.heartbeat(expiry)
+			return lock, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unexpected output while locking %s: %s", host.GetName(), output))
+}
+
+/*
+Keep the lock from going stale while it's held, however long the deployment takes, by touching it several times within
+the expiry. The age of a lock is the time since it was last touched, so only locks of deployments that stopped without
+releasing them expire.
+*/
+func (lock *Lock) heartbeat(expiry time.Duration) {
+	interval := expiry / 4
+	if interval < 5*time.Second {
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.done:
+			return
+		case <-ticker.C:
+		}
+
+		output, err := lock.run(fmt.Sprintf(`dir=%s
+if grep -qF %s "$dir/holder" 2>/dev/null; then
+	touch "$dir"
+	echo held
+else
+	echo "lost $(cat "$dir/holder" 2>/dev/null)"
+fi`, lockDir, utils.ShellJoin(lock.holder.Token)))
+		if err != nil {
+			// the host may be rebooting, try again at the next beat
+			continue
+		}
+
+		if status, data, _ := strings.Cut(strings.TrimSpace(output), " "); status == "lost" {
+			events.Publish(events.Log{
+				Host:    lock.host.GetName(),
+				Message: fmt.Sprintf("Lost the lock on %s, it's now held by %s", lock.host.GetName(), parseHolder(data)),
+			})
+			return
+		}
+	}
+}
+
+// Release the lock, unless it has been taken over by someone else in the meantime
+func (lock *Lock) Release() error {
+	close(lock.done)
+
+	script := fmt.Sprintf(`dir=%s
+if grep -qF %s "$dir/holder" 2>/dev/null; then
+	rm -rf "$dir"
+fi`, lockDir, utils.ShellJoin(lock.holder.Token))
+
+	_, err := lock.run(script)
+	return err
+}
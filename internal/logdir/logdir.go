@@ -0,0 +1,251 @@
+package logdir
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/report"
+)
+
+const (
+	RunLog       = "run.log"
+	ManifestFile = "manifest.json"
+	hostsDir     = "hosts"
+)
+
+// Links the hosts of a run to their log files and outcomes. Paths are relative to the run directory.
+type Manifest struct {
+	Command   string          `json:"command"`
+	Success   bool            `json:"success"`
+	Error     string          `json:"error,omitempty"`
+	StartTime time.Time       `json:"startTime"`
+	EndTime   time.Time       `json:"endTime"`
+	Duration  time.Duration   `json:"duration"`
+	RunLog    string          `json:"runLog"`
+	Hosts     []*ManifestHost `json:"hosts"`
+}
+
+type ManifestHost struct {
+	Name string `json:"name"`
+	// Empty if nothing was logged for the host
+	LogFile    string        `json:"logFile,omitempty"`
+	Status     string        `json:"status"`
+	Reason     string        `json:"reason,omitempty"`
+	FailedStep string        `json:"failedStep,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// A subscriber writing the events of a run to a directory of its own: a log file per host with everything done on
+// that host, a log of the whole run, and a manifest written when the run is done.
+type RunDir struct {
+	Path      string
+	hostNames []string
+	runLog    *logFile
+	hostLogs  map[string]*logFile
+	collector *report.Collector
+	// Close may be called while events are still published, e.g. when interrupted
+	lock   sync.Mutex
+	closed bool
+}
+
+// A log file where each line starts with the time it was written, and the host for the run log
+type logFile struct {
+	file        *os.File
+	atLineStart bool
+}
+
+func openLogFile(path string) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{file: file, atLineStart: true}, nil
+}
+
+func (log *logFile) write(t time.Time, hostName string, text string) {
+	timestamp := t.Format("15:04:05.000 ")
+	if hostName != "" {
+		timestamp += "[" + hostName + "] "
+	}
+	for text != "" {
+		line := text
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			line = text[:i+1]
+		}
+		if log.atLineStart {
+			log.file.WriteString(timestamp)
+		}
+		log.file.WriteString(line)
+		log.atLineStart = strings.HasSuffix(line, "\n")
+		text = text[len(line):]
+	}
+}
+
+// Create a directory for a run of the command, named after the current time, under dir
+func New(dir string, command string, hostNames []string) (*RunDir, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	name := time.Now().Format("2006-01-02T15-04-05") + "-" + command
+	path := filepath.Join(dir, name)
+	// runs started within the same second get a suffix
+	for i := 2; ; i++ {
+		err = os.Mkdir(path, 0755)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d", name, i))
+	}
+
+	err = os.Mkdir(filepath.Join(path, hostsDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	runLog, err := openLogFile(filepath.Join(path, RunLog))
+	if err != nil {
+		return nil, err
+	}
+
+	return &RunDir{
+		Path:      path,
+		hostNames: hostNames,
+		runLog:    runLog,
+		hostLogs:  make(map[string]*logFile),
+		collector: report.NewCollector(command),
+	}, nil
+}
+
+func hostLogName(hostName string) string {
+	return filepath.Join(hostsDir, strings.ReplaceAll(hostName, "/", "_")+".log")
+}
+
+func (d *RunDir) hostLog(hostName string) *logFile {
+	log, ok := d.hostLogs[hostName]
+	if !ok {
+		var err error
+		log, err = openLogFile(filepath.Join(d.Path, hostLogName(hostName)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create log file for %s: %s\n", hostName, err)
+			log = nil
+		}
+		// don't retry for every event if the file can't be created
+		d.hostLogs[hostName] = log
+	}
+	return log
+}
+
+func (d *RunDir) Handle(record events.Record) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	d.collector.Handle(record)
+
+	var text bytes.Buffer
+	switch e := record.Event.(type) {
+	case events.HostStarted:
+		fmt.Fprintf(&text, "Started: %s\n", e.Host)
+	case events.HostFinished:
+		if e.Error != "" {
+			fmt.Fprintf(&text, "Failed: %s (after %s): %s\n", e.Host, e.Duration.Round(time.Millisecond), e.Error)
+		} else {
+			fmt.Fprintf(&text, "Done: %s (after %s)\n", e.Host, e.Duration.Round(time.Millisecond))
+		}
+	case events.StepStarted:
+		fmt.Fprintf(&text, "--- %s\n", e.Step)
+	default:
+		events.Render(&text, record.Event)
+	}
+	if text.Len() == 0 {
+		return
+	}
+
+	hostName := events.HostOf(record.Event)
+	d.runLog.write(record.Time, hostName, text.String())
+	if hostName != "" {
+		if log := d.hostLog(hostName); log != nil {
+			log.write(record.Time, "", text.String())
+		}
+	}
+}
+
+// Write the manifest with the outcome of the run, and close the log files. Events published afterwards are ignored.
+func (d *RunDir) Close(runErr error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	result := d.collector.Finish(runErr)
+	manifest := Manifest{
+		Command:   result.Command,
+		Success:   result.Success,
+		Error:     result.Error,
+		StartTime: result.StartTime,
+		EndTime:   result.EndTime,
+		Duration:  result.Duration,
+		RunLog:    RunLog,
+		Hosts:     []*ManifestHost{},
+	}
+
+	reported := make(map[string]*report.Host)
+	for _, host := range result.Hosts {
+		reported[host.Name] = host
+	}
+	for _, hostName := range d.hostNames {
+		entry := &ManifestHost{Name: hostName, Status: report.StatusNotStarted}
+		if log := d.hostLogs[hostName]; log != nil {
+			entry.LogFile = hostLogName(hostName)
+		}
+		if host, ok := reported[hostName]; ok && host.Status != "" {
+			entry.Status = host.Status
+			entry.Reason = host.Reason
+			entry.FailedStep = host.FailedStep
+			if entry.FailedStep == "" && host.Status == report.StatusFailed {
+				for _, step := range host.Steps {
+					if step.Status == report.StatusFailed {
+						entry.FailedStep = step.Type
+					}
+				}
+			}
+			entry.Error = host.Error
+			entry.Duration = host.Duration
+		}
+		manifest.Hosts = append(manifest.Hosts, entry)
+	}
+
+	for _, log := range d.hostLogs {
+		if log != nil {
+			log.file.Close()
+		}
+	}
+	d.runLog.file.Close()
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(d.Path, ManifestFile), append(data, '\n'), 0644)
+}
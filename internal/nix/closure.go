@@ -0,0 +1,92 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+// Number of paths to query the size of per nix-store invocation, to keep command lines reasonably short
+const sizeQueryBatch = 500
+
+// Run a command on the host, or locally if host is nil, returning its output
+func runOn(sshContext *ssh.SSHContext, host *Host, args ...string) (string, error) {
+	var (
+		cmd *exec.Cmd
+		err error
+	)
+	if host != nil {
+		cmd, err = sshContext.Cmd(host, args...)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		where := "locally"
+		if host != nil {
+			where = fmt.Sprintf("on %s (%s)", host.Name, host.TargetHost)
+		}
+		errorMessage := fmt.Sprintf(
+			"Error while running `%s` %s: %s\n%s", args[0], where, err.Error(), stderr.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	return stdout.String(), nil
+}
+
+// Run `nix-store --query` on the host, or locally if host is nil
+func queryStore(sshContext *ssh.SSHContext, host *Host, args ...string) (string, error) {
+	return runOn(sshContext, host, append([]string{"nix-store", "--query"}, args...)...)
+}
+
+// Get the closure of a store path along with the size of each path in it, on the host, or locally if host is nil
+func GetClosureSizes(sshContext *ssh.SSHContext, host *Host, path string) (map[string]int64, error) {
+	output, err := queryStore(sshContext, host, "--requisites", path)
+	if err != nil {
+		return nil, err
+	}
+	paths := strings.Fields(output)
+
+	sizes := make(map[string]int64)
+	for start := 0; start < len(paths); start += sizeQueryBatch {
+		end := start + sizeQueryBatch
+		if end > len(paths) {
+			end = len(paths)
+		}
+		batch := paths[start:end]
+
+		output, err := queryStore(sshContext, host, append([]string{"--size"}, batch...)...)
+		if err != nil {
+			return nil, err
+		}
+
+		lines := strings.Fields(output)
+		if len(lines) != len(batch) {
+			return nil, errors.New(fmt.Sprintf("Expected the size of %d paths from nix-store, got %d", len(batch), len(lines)))
+		}
+		for i, line := range lines {
+			size, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			sizes[batch[i]] = size
+		}
+	}
+
+	return sizes, nil
+}
@@ -0,0 +1,358 @@
+package nix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Cached evaluations not used for this long are deleted
+	evalCacheExpiry = 30 * 24 * time.Hour
+	// Deployments in directories with more files than this aren't cached, since hashing them would take too long
+	evalCacheMaxFiles = 20000
+)
+
+/*
+Results of evaluating a deployment, kept between runs under the user's cache directory. Entries are keyed on everything
+the evaluation depends on that can be checked without evaluating: the contents of the files in the directory of the
+deployment (including flake.lock), eval-machines.nix, the Nix search path and the flake flags. Any change to those
+makes a new key, so entries never have to be invalidated.
+
+Deployments also import files from elsewhere, e.g. modules shared between deployments, so each entry records the files
+Nix evaluated to produce it, and is only used while all of them are unchanged.
+*/
+type evalCache struct {
+	dir  string
+	key  string
+	lock sync.Mutex
+}
+
+var (
+	evalCaches     = make(map[string]*evalCache)
+	evalCachesLock sync.Mutex
+)
+
+// The cache for the deployment, or nil if caching is disabled, or the deployment can't be cached, e.g. a remote flake
+func (nixContext *NixContext) evalCache(deploymentPath string) *evalCache {
+	if !nixContext.EvalCache {
+		return nil
+	}
+
+	evalCachesLock.Lock()
+	defer evalCachesLock.Unlock()
+
+	// Hashing the inputs is done once per run
+	if cache, ok := evalCaches[deploymentPath]; ok {
+		return cache
+	}
+
+	cache, err := nixContext.newEvalCache(deploymentPath)
+	if err != nil {
+		cache = nil
+	}
+	evalCaches[deploymentPath] = cache
+
+	return cache
+}
+
+func (nixContext *NixContext) newEvalCache(deploymentPath string) (*evalCache, error) {
+	inputsDir := filepath.Dir(deploymentPath)
+	if ref, ok := ParseFlakeRef(deploymentPath); ok {
+		if ref.Dir == "" {
+			return nil, errors.New("Remote flakes aren't cached")
+		}
+		inputsDir = ref.Dir
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "deployment %s\n", deploymentPath)
+	for _, arg := range nixContext.FlakeArgs {
+		fmt.Fprintf(hash, "flake arg %s\n", arg)
+	}
+
+	// The files of the deployment, and eval-machines.nix with the modules next to it
+	if err = hashFiles(hash, inputsDir); err != nil {
+		return nil, err
+	}
+	evalFiles, _ := filepath.Glob(filepath.Join(filepath.Dir(nixContext.EvalMachines), "*.nix"))
+	for _, path := range evalFiles {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(hash, "eval file %s\n", path)
+		hash.Write(contents)
+	}
+
+	// Channels are symlinks into the store, so resolving them catches updates
+	for _, entry := range filepath.SplitList(os.Getenv("NIX_PATH")) {
+		_, path, found := strings.Cut(entry, "=")
+		if !found {
+			path = entry
+		}
+		resolved, _ := filepath.EvalSymlinks(path)
+		fmt.Fprintf(hash, "search path %s %s\n", entry, resolved)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		resolved, _ := filepath.EvalSymlinks(filepath.Join(home, ".nix-defexpr/channels"))
+		fmt.Fprintf(hash, "channels %s\n", resolved)
+	}
+
+	return &evalCache{
+		dir: filepath.Join(cacheDir, "quetzal", "eval"),
+		key: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+/*
+Hash the contents of every file under dir, along with its path. Hidden directories (e.g. .git and .gcroots) are skipped,
+as are symlinks into the Nix store, like the result links of nix-build.
+*/
+func hashFiles(hash io.Writer, dir string) error {
+	files := 0
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if files++; files > evalCacheMaxFiles {
+			return errors.New(fmt.Sprintf("More than %d files in %s", evalCacheMaxFiles, dir))
+		}
+		if entry.IsDir() {
+			if path != dir && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relativePath, _ := filepath.Rel(dir, path)
+		if entry.Type()&fs.ModeSymlink != 0 {
+			target, _ := os.Readlink(path)
+			if !strings.HasPrefix(target, "/nix/store/") {
+				fmt.Fprintf(hash, "link %s %s\n", relativePath, target)
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fmt.Fprintf(hash, "file %s\n", relativePath)
+		_, err = io.Copy(hash, file)
+		return err
+	})
+}
+
+// The file of an entry: what was evaluated, e.g. "info.deployment", and any arguments it was evaluated with
+func (cache *evalCache) file(what string, args ...string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n", cache.key, what)
+	for _, arg := range args {
+		fmt.Fprintf(hash, "%s\n", arg)
+	}
+
+	return filepath.Join(cache.dir, hex.EncodeToString(hash.Sum(nil)))
+}
+
+type evalCacheEntry struct {
+	Value []byte `json:"value"`
+	// The hashes of the files evaluated, outside the Nix store
+	Files map[string]string `json:"files"`
+}
+
+func (cache *evalCache) get(what string, args ...string) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+
+	file := cache.file(what, args...)
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+
+	var entry evalCacheEntry
+	if err = json.Unmarshal(contents, &entry); err != nil {
+		return nil, false
+	}
+	for path, hash := range entry.Files {
+		if current, err := hashFile(path); err != nil || current != hash {
+			return nil, false
+		}
+	}
+
+	// keep entries in use from expiring
+	now := time.Now()
+	_ = os.Chtimes(file, now, now)
+
+	return entry.Value, true
+}
+
+/*
+Store an entry, along with the files read while evaluating it. The cache is only an optimization, so failing to write
+to it is ignored. Entries for evaluations that didn't report the files they read, e.g. with a Nix logging differently,
+aren't stored, since they couldn't be checked.
+*/
+func (cache *evalCache) put(value []byte, reads *evalReads, what string, args ...string) {
+	if cache == nil || reads == nil || len(reads.files) == 0 {
+		return
+	}
+
+	entry := evalCacheEntry{Value: value, Files: make(map[string]string)}
+	for _, path := range reads.files {
+		if strings.HasPrefix(path, "/nix/store/") {
+			continue
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return
+		}
+		entry.Files[path] = hash
+	}
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if err := os.MkdirAll(cache.dir, 0700); err != nil {
+		return
+	}
+	cache.expire()
+
+	file := cache.file(what, args...)
+	tmp, err := os.CreateTemp(cache.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(contents)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+func (cache *evalCache) expire() {
+	entries, err := os.ReadDir(cache.dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > evalCacheExpiry {
+			os.Remove(filepath.Join(cache.dir, entry.Name()))
+		}
+	}
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Nix logs each file it evaluates with -v
+const evaluatingFilePrefix = "evaluating file '"
+
+// Arguments making Nix report the files it evaluates, when the evaluation is cached
+func (cache *evalCache) trackArgs() []string {
+	if cache == nil {
+		return nil
+	}
+
+	return []string{"-v"}
+}
+
+// The output of an evaluation, passed on except for the lines reporting evaluated files, which are recorded instead
+type evalReads struct {
+	out     io.Writer
+	partial []byte
+	files   []string
+}
+
+func trackReads(out io.Writer) *evalReads {
+	return &evalReads{out: out}
+}
+
+func (reads *evalReads) Write(p []byte) (int, error) {
+	n := len(p)
+	p = append(reads.partial, p...)
+	reads.partial = nil
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			// hold back what may become a line reporting a file, and pass on progress output right away
+			if bytes.HasPrefix(p, []byte(evaluatingFilePrefix)) || bytes.HasPrefix([]byte(evaluatingFilePrefix), p) {
+				reads.partial = append([]byte{}, p...)
+				return n, nil
+			}
+			i = len(p) - 1
+		}
+
+		line := p[:i+1]
+		p = p[i+1:]
+		if path, ok := evaluatedFile(string(line)); ok {
+			reads.files = append(reads.files, path)
+			continue
+		}
+		if _, err := reads.out.Write(line); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Pass on output held back at the end of the evaluation
+func (reads *evalReads) Flush() {
+	if len(reads.partial) > 0 {
+		reads.out.Write(reads.partial)
+		reads.partial = nil
+	}
+}
+
+func evaluatedFile(line string) (string, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, evaluatingFilePrefix) || !strings.HasSuffix(line, "'") {
+		return "", false
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(line, evaluatingFilePrefix), "'"), true
+}
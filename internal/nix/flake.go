@@ -0,0 +1,132 @@
+package nix
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The flake output holding the network, when a flake reference doesn't name one
+const DefaultFlakeAttr = "quetzal"
+
+// A deployment given as a flake output, e.g. ".#quetzal" or "github:org/infra#prod", instead of a file
+type FlakeRef struct {
+	// The flake, with local paths made absolute
+	Flake string
+	// The output holding the network, in the same format as a deployment file
+	Attr string
+	// The local directory of the flake, empty for remote flakes
+	Dir string
+}
+
+/*
+Parse the deployment argument as a flake reference. Anything with a "#" is a flake reference, as is a directory
+containing a flake.nix, using its "quetzal" output. Everything else is a deployment file.
+*/
+func ParseFlakeRef(deployment string) (*FlakeRef, bool) {
+	flake, attr, hasAttr := strings.Cut(deployment, "#")
+	if !hasAttr {
+		if _, err := os.Stat(filepath.Join(deployment, "flake.nix")); err != nil {
+			return nil, false
+		}
+	}
+	if flake == "" {
+		flake = "."
+	}
+	if attr == "" {
+		attr = DefaultFlakeAttr
+	}
+
+	ref := &FlakeRef{Flake: flake, Attr: attr}
+
+	localPath := ""
+	switch {
+	case strings.HasPrefix(flake, ".") || strings.HasPrefix(flake, "/"):
+		localPath = flake
+	case strings.HasPrefix(flake, "path:"):
+		localPath = strings.TrimPrefix(flake, "path:")
+	case strings.HasPrefix(flake, "git+file://"):
+		localPath = strings.TrimPrefix(flake, "git+file://")
+	}
+	if localPath != "" {
+		// the flake is in the directory given by ?dir=..., relative to the path
+		localPath, query, _ := strings.Cut(localPath, "?")
+		if dir, err := filepath.Abs(localPath); err == nil {
+			if localPath == flake {
+				ref.Flake = dir
+			}
+			if params, err := url.ParseQuery(query); err == nil && params.Get("dir") != "" {
+				dir = filepath.Join(dir, params.Get("dir"))
+			}
+			ref.Dir = dir
+		}
+	}
+
+	return ref, true
+}
+
+func (ref *FlakeRef) String() string {
+	return ref.Flake + "#" + ref.Attr
+}
+
+// The deployment as passed to Nix: the absolute path of the deployment file, or the flake reference
+func DeploymentPath(deployment string) (string, error) {
+	if ref, ok := ParseFlakeRef(deployment); ok {
+		return ref.String(), nil
+	}
+
+	return filepath.Abs(deployment)
+}
+
+// The directory paths in the deployment are relative to, e.g. the sources of secrets. For remote flakes, that's the
+// working directory.
+func DeploymentDir(deployment string) (string, error) {
+	if ref, ok := ParseFlakeRef(deployment); ok {
+		if ref.Dir != "" {
+			return ref.Dir, nil
+		}
+		return os.Getwd()
+	}
+
+	return filepath.Abs(filepath.Dir(deployment))
+}
+
+// Quote a string for use in a Nix expression
+func nixString(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "${", `\${`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+/*
+Arguments for `nix eval` in flake mode, evaluating expr against the deployment evaluated from the network in the flake
+output. Evaluation is impure, since eval-machines.nix is outside the flake.
+*/
+func (nixContext *NixContext) flakeEvalArgs(ref *FlakeRef, expr string, nixConfig map[string]string, extra ...string) []string {
+	apply := fmt.Sprintf("network: let deployment = import %s { inherit network; }; in %s", nixString(nixContext.EvalMachines), expr)
+
+	args := append(flakeFeatures(), "eval", "--impure", ref.String(), "--apply", apply)
+	args = append(args, nixContext.FlakeArgs...)
+	args = append(args, mkOptions(nixConfig)...)
+	if nixContext.ShowTrace {
+		args = append(args, "--show-trace")
+	}
+
+	return append(args, extra...)
+}
+
+// The nix CLI needs these features for flakes, unless they're already enabled in nix.conf
+func flakeFeatures() []string {
+	return []string{"--extra-experimental-features", "nix-command", "--extra-experimental-features", "flakes"}
+}
+
+// The expression for the derivation building the machines, see `machines` in eval-machines.nix
+func machinesExpr(argsFile string, nixBuildTargets string) string {
+	buildTargets := "null"
+	if nixBuildTargets != "" {
+		buildTargets = "(" + nixBuildTargets + ")"
+	}
+
+	return fmt.Sprintf("(deployment.machines { argsFile = %s; buildTargets = %s; }).drvPath", nixString(argsFile), buildTargets)
+}
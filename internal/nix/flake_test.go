@@ -0,0 +1,72 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFlakeRef(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		deployment string
+		want       FlakeRef
+	}{
+		{".#prod", FlakeRef{Flake: cwd, Attr: "prod", Dir: cwd}},
+		{"#prod", FlakeRef{Flake: cwd, Attr: "prod", Dir: cwd}},
+		{".#", FlakeRef{Flake: cwd, Attr: DefaultFlakeAttr, Dir: cwd}},
+		{"./infra#prod", FlakeRef{Flake: filepath.Join(cwd, "infra"), Attr: "prod", Dir: filepath.Join(cwd, "infra")}},
+		{"/srv/infra#quetzal.prod", FlakeRef{Flake: "/srv/infra", Attr: "quetzal.prod", Dir: "/srv/infra"}},
+		{"path:/srv/infra#prod", FlakeRef{Flake: "path:/srv/infra", Attr: "prod", Dir: "/srv/infra"}},
+		{"path:/srv/infra?dir=sub#prod", FlakeRef{Flake: "path:/srv/infra?dir=sub", Attr: "prod", Dir: "/srv/infra/sub"}},
+		{"git+file:///srv/infra?ref=main&dir=network/prod#prod", FlakeRef{Flake: "git+file:///srv/infra?ref=main&dir=network/prod", Attr: "prod", Dir: "/srv/infra/network/prod"}},
+		{"git+file:///srv/infra#prod", FlakeRef{Flake: "git+file:///srv/infra", Attr: "prod", Dir: "/srv/infra"}},
+		{"github:org/infra#prod", FlakeRef{Flake: "github:org/infra", Attr: "prod"}},
+		{"git+https://example.com/infra.git?ref=main#prod", FlakeRef{Flake: "git+https://example.com/infra.git?ref=main", Attr: "prod"}},
+	}
+
+	for _, test := range tests {
+		got, ok := ParseFlakeRef(test.deployment)
+		if !ok {
+			t.Errorf("ParseFlakeRef(%q): not a flake reference", test.deployment)
+			continue
+		}
+		if *got != test.want {
+			t.Errorf("ParseFlakeRef(%q) = %+v, want %+v", test.deployment, *got, test.want)
+		}
+	}
+}
+
+func TestParseFlakeRefDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if ref, ok := ParseFlakeRef(dir); ok {
+		t.Fatalf("ParseFlakeRef(%q) = %+v for a directory without a flake", dir, *ref)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "flake.nix"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ref, ok := ParseFlakeRef(dir)
+	if !ok {
+		t.Fatalf("ParseFlakeRef(%q): not a flake reference", dir)
+	}
+	want := FlakeRef{Flake: dir, Attr: DefaultFlakeAttr, Dir: dir}
+	if *ref != want {
+		t.Errorf("ParseFlakeRef(%q) = %+v, want %+v", dir, *ref, want)
+	}
+	if ref.String() != dir+"#"+DefaultFlakeAttr {
+		t.Errorf("String() = %q", ref.String())
+	}
+}
+
+func TestParseFlakeRefFiles(t *testing.T) {
+	for _, deployment := range []string{"deployment.nix", "./network/prod.nix", "/srv/infra/deployment.nix"} {
+		if ref, ok := ParseFlakeRef(deployment); ok {
+			t.Errorf("ParseFlakeRef(%q) = %+v, want a deployment file", deployment, *ref)
+		}
+	}
+}
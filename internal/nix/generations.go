@@ -0,0 +1,132 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+// A generation of the system profile on a host
+type Generation struct {
+	Number int `json:"number"`
+	// As shown by nix-env, in the timezone of the host
+	Date    string `json:"date"`
+	Current bool   `json:"current"`
+	Path    string `json:"path"`
+}
+
+func generationLink(number int) string {
+	return fmt.Sprintf("%s-%d-link", ssh.SystemProfile, number)
+}
+
+// List the generations of the system profile on the host, oldest first
+func ListGenerations(sshContext *ssh.SSHContext, host *Host) ([]Generation, error) {
+	output, err := runOn(sshContext, host, "nix-env", "--list-generations", "--profile", ssh.SystemProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	generations := []Generation{}
+	links := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		// e.g. "  41   2024-05-01 12:00:00   (current)"
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unexpected output from nix-env on %s: %s", host.Name, line))
+		}
+		generations = append(generations, Generation{
+			Number:  number,
+			Date:    fields[1] + " " + fields[2],
+			Current: len(fields) > 3 && fields[3] == "(current)",
+		})
+		links = append(links, generationLink(number))
+	}
+
+	if len(generations) == 0 {
+		return generations, nil
+	}
+
+	output, err = runOn(sshContext, host, append([]string{"readlink", "-f"}, links...)...)
+	if err != nil {
+		return nil, err
+	}
+	paths := strings.Fields(output)
+	if len(paths) != len(generations) {
+		return nil, errors.New(fmt.Sprintf("Expected the store path of %d generations on %s, got %d", len(generations), host.Name, len(paths)))
+	}
+	for i := range generations {
+		generations[i].Path = paths[i]
+	}
+
+	return generations, nil
+}
+
+// The current time on the host, in its timezone, for comparing with the dates of generations
+func GetHostTime(sshContext *ssh.SSHContext, host *Host) (time.Time, error) {
+	output, err := runOn(sshContext, host, "date", "+%Y-%m-%dT%H:%M:%S")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse("2006-01-02T15:04:05", strings.TrimSpace(output))
+}
+
+// The date of the generation, in the timezone of the host
+func (generation *Generation) Time() (time.Time, error) {
+	return time.Parse(time.DateTime, generation.Date)
+}
+
+// Delete generations of the system profile on the host. The current generation is never deleted by nix-env.
+func DeleteGenerations(sshContext *ssh.SSHContext, host *Host, numbers []int) error {
+	args := []string{"sudo", "nix-env", "--profile", ssh.SystemProfile, "--delete-generations"}
+	for _, number := range numbers {
+		args = append(args, strconv.Itoa(number))
+	}
+
+	_, err := runOn(sshContext, host, args...)
+	return err
+}
+
+var gcFreedPattern = regexp.MustCompile(`([0-9.]+) (bytes|KiB|MiB|GiB|TiB) freed`)
+
+// Delete unreachable paths from the Nix store of the host, returning the number of bytes freed, as reported by Nix
+func CollectGarbage(sshContext *ssh.SSHContext, host *Host) (int64, error) {
+	cmd, err := sshContext.SudoCmd(host, "nix-store", "--gc")
+	if err != nil {
+		return 0, err
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error while collecting garbage on %s (%s): %s\n%s", host.Name, host.TargetHost, err.Error(), string(output),
+		)
+		return 0, errors.New(errorMessage)
+	}
+
+	match := gcFreedPattern.FindStringSubmatch(string(output))
+	if match == nil {
+		return 0, nil
+	}
+	freed, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	for _, unit := range []string{"bytes", "KiB", "MiB", "GiB", "TiB"} {
+		if unit == match[2] {
+			break
+		}
+		freed *= 1024
+	}
+
+	return int64(freed), nil
+}
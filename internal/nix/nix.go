@@ -10,12 +10,14 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
 	"github.com/quetzal-deploy/quetzal/internal/healthchecks"
+	"github.com/quetzal-deploy/quetzal/internal/hooks"
 	"github.com/quetzal-deploy/quetzal/internal/secrets"
 	"github.com/quetzal-deploy/quetzal/internal/ssh"
 	"github.com/quetzal-deploy/quetzal/internal/utils"
@@ -34,6 +36,9 @@ type Host struct {
 	SubstituteOnDestination bool
 	NixConfig               map[string]string
 	Tags                    []string
+	Hooks                   hooks.Hooks
+	// Seconds to wait for the host to come back after rebooting
+	RebootTimeout int
 }
 
 type HostOrdering struct {
@@ -43,6 +48,11 @@ type HostOrdering struct {
 type DeploymentMetadata struct {
 	Description string
 	Ordering    HostOrdering
+	Constraints []string
+	Webhooks    []common.Webhook
+	// Always ask before changing hosts, or only when changing hosts with any of the tags
+	RequireConfirmation bool
+	ConfirmationTags    []string
 }
 
 type Deployment struct {
@@ -58,6 +68,12 @@ type NixContext struct {
 	ShowTrace       bool
 	KeepGCRoot      bool
 	AllowBuildShell bool
+	// The nix CLI, used for deployments in flakes
+	NixCmd string
+	// Extra arguments for evaluating flakes, e.g. --override-input and lock file flags
+	FlakeArgs []string
+	// Reuse evaluations of unchanged deployments from earlier runs, see evalCache
+	EvalCache bool
 }
 
 type NixBuildInvocationArgs struct {
@@ -94,6 +110,29 @@ func (nArgs *NixBuildInvocationArgs) ToNixBuildArgs() []string {
 	return args
 }
 
+// Arguments for nix-instantiate, evaluating the derivation nix-build would build
+func (nArgs *NixBuildInvocationArgs) ToNixInstantiateArgs() []string {
+	args := []string{
+		nArgs.NixContext.EvalMachines,
+		"--arg", "networkExpr", nArgs.DeploymentPath,
+		"--argstr", "argsFile", nArgs.ArgsFile,
+		"--attr", nArgs.Attr,
+	}
+
+	args = append(args, mkOptions(nArgs.NixConfig)...)
+
+	if nArgs.NixContext.ShowTrace {
+		args = append(args, "--show-trace")
+	}
+
+	if nArgs.NixBuildTargets != "" {
+		args = append(args,
+			"--arg", "buildTargets", nArgs.NixBuildTargets)
+	}
+
+	return args
+}
+
 func (nArgs *NixEvalInvocationArgs) ToNixInstantiateArgs() []string {
 	args := []string{
 		"--eval", nArgs.NixContext.EvalMachines,
@@ -159,67 +198,53 @@ func (host *Host) GetTags() []string {
 	return host.Tags
 }
 
-func (host *Host) Reboot(sshContext *ssh.SSHContext) error {
-
-	var (
-		oldBootID string
-		newBootID string
-	)
-
+// Reboot the host, and wait for it to come back. The timeout in seconds overrides the reboot timeout of the host, if set.
+func (host *Host) Reboot(sshContext *ssh.SSHContext, timeout int) error {
 	oldBootID, err := sshContext.GetBootID(host)
 	// If the host doesn't support getting boot ID's for some reason, warn about it, and skip the comparison
 	skipBootIDComparison := err != nil
 	if skipBootIDComparison {
-		fmt.Fprintf(os.Stderr, "Error getting boot ID (this is used to determine when the reboot is complete): %v\n", err)
-		fmt.Fprintf(os.Stderr, "This makes it impossible to detect when the host has rebooted, so health checks might pass before the host has rebooted.\n")
+		events.Publish(events.Log{Host: host.Name, Message: fmt.Sprintf("Error getting boot ID (this is used to determine when the reboot is complete): %v", err)})
+		events.Publish(events.Log{Host: host.Name, Message: "This makes it impossible to detect when the host has rebooted, so health checks might pass before the host has rebooted."})
 	}
 
+	events.Publish(events.RebootStarted{Host: host.Name})
 	if cmd, err := sshContext.Cmd(host, "sudo", "reboot"); cmd != nil {
-		fmt.Fprint(os.Stderr, "Asking host to reboot ... ")
+		disconnected := false
 		if err = cmd.Run(); err != nil {
 			// Here we assume that exit code 255 means: "SSH connection got disconnected",
 			// which is OK for a reboot - sshd may close active connections before we disconnect after all
 			if exitErr, ok := err.(*exec.ExitError); ok {
 				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 255 {
-					fmt.Fprintln(os.Stderr, "Remote host disconnected.")
+					disconnected = true
 					err = nil
 				}
 			}
 		}
 
+		events.Publish(events.RebootRequested{Host: host.Name, Disconnected: disconnected, Error: events.ErrorString(err)})
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Failed")
 			return err
 		}
+	} else {
+		events.Publish(events.RebootRequested{Host: host.Name})
 	}
 
-	fmt.Fprintln(os.Stderr, "OK")
-
 	if !skipBootIDComparison {
-		fmt.Fprint(os.Stderr, "Waiting for host to come online ")
-
-		// Wait for the host to get a new boot ID. These ID's should be unique for each boot,
-		// meaning a reboot will have been completed when the boot ID has changed.
-		for {
-			fmt.Fprint(os.Stderr, ".")
-
-			// Ignore errors; there'll be plenty of them since we'll be attempting to connect to an offline host,
-			// and we know from previously that the host should support boot ID's
-			newBootID, _ = sshContext.GetBootID(host)
-
-			if newBootID != "" && oldBootID != newBootID {
-				fmt.Fprintln(os.Stderr, " OK")
-				break
-			}
-
-			time.Sleep(2 * time.Second)
-		}
+		// Boot ID's should be unique for each boot, meaning a reboot will have been completed when the boot ID has changed.
+		return host.waitForReboot(sshContext, oldBootID, host.GetRebootTimeout(timeout))
 	}
 
 	return nil
 }
 
 func (nixContext *NixContext) GetBuildShell(deploymentPath string) (buildShell *string, err error) {
+	cache := nixContext.evalCache(deploymentPath)
+	if cached, ok := cache.get("info.buildShell"); ok {
+		if err = json.Unmarshal(cached, &buildShell); err == nil {
+			return buildShell, nil
+		}
+	}
 
 	nixEvalInvocationArgs := NixEvalInvocationArgs{
 		AsJSON:         true,
@@ -234,11 +259,15 @@ func (nixContext *NixContext) GetBuildShell(deploymentPath string) (buildShell *
 		return buildShell, err
 	}
 
-	cmd := exec.Command(nixContext.EvalCmd, nixEvalInvocationArgs.ToNixInstantiateArgs()...)
+	cmd := exec.Command(nixContext.EvalCmd, append(nixEvalInvocationArgs.ToNixInstantiateArgs(), cache.trackArgs()...)...)
+	if ref, ok := ParseFlakeRef(deploymentPath); ok {
+		cmd = exec.Command(nixContext.NixCmd, nixContext.flakeEvalArgs(ref, "deployment.info.buildShell", nil, append([]string{"--json"}, cache.trackArgs()...)...)...)
+	}
 
 	var stdout bytes.Buffer
+	reads := trackReads(events.NewOutputWriter(""))
 	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = reads
 
 	utils.AddFinalizer(func() {
 		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
@@ -248,9 +277,10 @@ func (nixContext *NixContext) GetBuildShell(deploymentPath string) (buildShell *
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, fmt.Sprintf("QUETZAL_ARGS=%s", jsonArgs))
 	err = cmd.Run()
+	reads.Flush()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
-			"Error while running `%s ..`: %s", nixContext.EvalCmd, err.Error(),
+			"Error while running `%s ..`: %s", cmd.Args[0], err.Error(),
 		)
 		return buildShell, errors.New(errorMessage)
 	}
@@ -259,10 +289,12 @@ func (nixContext *NixContext) GetBuildShell(deploymentPath string) (buildShell *
 	if err != nil {
 		return nil, err
 	}
+	cache.put(stdout.Bytes(), reads, "info.buildShell")
 
 	return buildShell, nil
 }
 
+// Evaluate an attribute of the deployment, returning its value as printed by nix-instantiate, or `nix eval` for flakes
 func (nixContext *NixContext) EvalHosts(deploymentPath string, attr string) (string, error) {
 	attribute := "nodes." + attr
 
@@ -280,6 +312,9 @@ func (nixContext *NixContext) EvalHosts(deploymentPath string, attr string) (str
 	}
 
 	cmd := exec.Command(nixContext.EvalCmd, nixEvalInvocationArgs.ToNixInstantiateArgs()...)
+	if ref, ok := ParseFlakeRef(deploymentPath); ok {
+		cmd = exec.Command(nixContext.NixCmd, nixContext.flakeEvalArgs(ref, "deployment."+attribute, nil)...)
+	}
 
 	utils.AddFinalizer(func() {
 		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
@@ -287,15 +322,24 @@ func (nixContext *NixContext) EvalHosts(deploymentPath string, attr string) (str
 		}
 	})
 
-	cmd.Stdout = os.Stdout
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, fmt.Sprintf("QUETZAL_ARGS=%s", jsonArgs))
 	err = cmd.Run()
-	return deploymentPath, err
+	return stdout.String(), err
 }
 
 func (nixContext *NixContext) GetMachines(deploymentPath string) (deployment Deployment, err error) {
+	cache := nixContext.evalCache(deploymentPath)
+	if cached, ok := cache.get("info.deployment"); ok {
+		if err = json.Unmarshal(cached, &deployment); err == nil {
+			events.Publish(events.Log{Message: "Using the cached evaluation of the deployment, since it hasn't changed (--no-eval-cache to evaluate anyway)"})
+			return deployment, nil
+		}
+		deployment = Deployment{}
+	}
 
 	nixEvalInvocationArgs := NixEvalInvocationArgs{
 		AsJSON:         true,
@@ -310,11 +354,15 @@ func (nixContext *NixContext) GetMachines(deploymentPath string) (deployment Dep
 		return deployment, err
 	}
 
-	cmd := exec.Command(nixContext.EvalCmd, nixEvalInvocationArgs.ToNixInstantiateArgs()...)
+	cmd := exec.Command(nixContext.EvalCmd, append(nixEvalInvocationArgs.ToNixInstantiateArgs(), cache.trackArgs()...)...)
+	if ref, ok := ParseFlakeRef(deploymentPath); ok {
+		cmd = exec.Command(nixContext.NixCmd, nixContext.flakeEvalArgs(ref, "deployment.info.deployment", nil, append([]string{"--json"}, cache.trackArgs()...)...)...)
+	}
 
 	var stdout bytes.Buffer
+	reads := trackReads(events.NewOutputWriter(""))
 	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = reads
 
 	utils.AddFinalizer(func() {
 		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
@@ -324,9 +372,10 @@ func (nixContext *NixContext) GetMachines(deploymentPath string) (deployment Dep
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, fmt.Sprintf("QUETZAL_ARGS=%s", jsonArgs))
 	err = cmd.Run()
+	reads.Flush()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
-			"Error while running `%s ..`: %s", nixContext.EvalCmd, err.Error(),
+			"Error while running `%s ..`: %s", cmd.Args[0], err.Error(),
 		)
 		return deployment, errors.New(errorMessage)
 	}
@@ -335,6 +384,7 @@ func (nixContext *NixContext) GetMachines(deploymentPath string) (deployment Dep
 	if err != nil {
 		return deployment, err
 	}
+	cache.put(stdout.Bytes(), reads, "info.deployment")
 
 	return deployment, nil
 }
@@ -353,11 +403,11 @@ func (nixContext *NixContext) BuildMachines(deploymentPath string, hosts []Host,
 		hostNames = append(hostNames, host.Name)
 	}
 
-	resultLinkPath := filepath.Join(path.Dir(deploymentPath), ".gcroots", path.Base(deploymentPath))
+	resultLinkPath := GCRootPath(deploymentPath)
 	if nixContext.KeepGCRoot {
 		if err = os.MkdirAll(path.Dir(resultLinkPath), 0755); err != nil {
 			nixContext.KeepGCRoot = false
-			fmt.Fprintf(os.Stderr, "Unable to create GC root, skipping: %s", err)
+			events.Publish(events.Log{Message: fmt.Sprintf("Unable to create GC root, skipping: %s", err)})
 		}
 	}
 	if !nixContext.KeepGCRoot {
@@ -396,19 +446,62 @@ func (nixContext *NixContext) BuildMachines(deploymentPath string, hosts []Host,
 		return "", err
 	}
 
+	// The derivation is cached along with the evaluation of the deployment. Build targets may come from anywhere, so
+	// builds with those aren't cached, and neither are builds in a build shell, which may evaluate differently.
+	cache := nixContext.evalCache(deploymentPath)
+	if nixBuildTargets != "" || (nixContext.AllowBuildShell && buildShell != nil) {
+		cache = nil
+	}
+	cacheArgs := append(append([]string{}, hostNames...), sortedNixConfig(hosts[0].NixConfig)...)
+	drvPath := ""
+	if cached, ok := cache.get("machines", cacheArgs...); ok {
+		// derivations are deleted by garbage collection like anything else in the store
+		if _, err := os.Stat(string(cached)); err == nil {
+			drvPath = string(cached)
+			events.Publish(events.Log{Message: "Using the cached evaluation of " + drvPath})
+		}
+	}
+
+	// Flakes are evaluated in flake mode, so lock files and input overrides apply, then the resulting derivation is
+	// built. Cached evaluations are done the same way, to know which files the derivation was evaluated from.
+	_, isFlake := ParseFlakeRef(deploymentPath)
+	if drvPath == "" && (isFlake || cache != nil) {
+		drvPath, err = nixContext.instantiateMachines(deploymentPath, &NixBuildInvocationArgs, jsonArgs, cache, cacheArgs)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	buildCmd, buildArgs := nixContext.BuildCmd, NixBuildInvocationArgs.ToNixBuildArgs()
+	if drvPath != "" {
+		buildArgs = append([]string{drvPath, "--out-link", resultLinkPath}, mkOptions(hosts[0].NixConfig)...)
+		if nixContext.ShowTrace {
+			buildArgs = append(buildArgs, "--show-trace")
+		}
+	}
+	if isFlake {
+		buildCmd = nixContext.NixCmd
+		buildArgs = append(flakeFeatures(), "build", "--out-link", resultLinkPath, drvPath+"^out")
+		buildArgs = append(buildArgs, mkOptions(hosts[0].NixConfig)...)
+		if nixContext.ShowTrace {
+			buildArgs = append(buildArgs, "--show-trace")
+		}
+	}
+
 	var cmd *exec.Cmd
 	if nixContext.AllowBuildShell && buildShell != nil {
 
-		shellArgs := strings.Join(append([]string{nixContext.BuildCmd}, NixBuildInvocationArgs.ToNixBuildArgs()...), " ")
+		shellArgs := strings.Join(append([]string{buildCmd}, buildArgs...), " ")
 		cmd = exec.Command(nixContext.ShellCmd, *buildShell, "--pure", "--run", shellArgs)
 	} else {
-		cmd = exec.Command(nixContext.BuildCmd, NixBuildInvocationArgs.ToNixBuildArgs()...)
+		cmd = exec.Command(buildCmd, buildArgs...)
 
 	}
 
-	// show process output on attached stdout/stderr
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
+	// show process output as it happens
+	output := events.NewOutputWriter("")
+	cmd.Stdout = output
+	cmd.Stderr = output
 	utils.AddFinalizer(func() {
 		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
 			_ = cmd.Process.Signal(syscall.SIGTERM)
@@ -435,6 +528,58 @@ func (nixContext *NixContext) BuildMachines(deploymentPath string, hosts []Host,
 	return
 }
 
+// Evaluate the derivation building the machines, returning its path, and caching it if the cache is enabled
+func (nixContext *NixContext) instantiateMachines(deploymentPath string, nArgs *NixBuildInvocationArgs, jsonArgs []byte, cache *evalCache, cacheArgs []string) (string, error) {
+	cmd := exec.Command(nixContext.EvalCmd, append(nArgs.ToNixInstantiateArgs(), cache.trackArgs()...)...)
+	if ref, ok := ParseFlakeRef(deploymentPath); ok {
+		expr := machinesExpr(nArgs.ArgsFile, nArgs.NixBuildTargets)
+		cmd = exec.Command(nixContext.NixCmd, nixContext.flakeEvalArgs(ref, expr, nArgs.NixConfig, append([]string{"--raw"}, cache.trackArgs()...)...)...)
+	}
+
+	var stdout bytes.Buffer
+	reads := trackReads(events.NewOutputWriter(""))
+	cmd.Stdout = &stdout
+	cmd.Stderr = reads
+
+	utils.AddFinalizer(func() {
+		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		}
+	})
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("QUETZAL_ARGS=%s", jsonArgs))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("QUETZAL_ARGS_FILE=%s", nArgs.ArgsFile))
+	err := cmd.Run()
+	reads.Flush()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error while running `%s ..`: %s", cmd.Args[0], err.Error(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	drvPath := strings.TrimSpace(stdout.String())
+	cache.put([]byte(drvPath), reads, "machines", cacheArgs...)
+
+	return drvPath, nil
+}
+
+// Nix config in a map, with the keys in order, for building cache keys from
+func sortedNixConfig(nixConfig map[string]string) []string {
+	keys := []string{}
+	for key := range nixConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	config := []string{}
+	for _, key := range keys {
+		config = append(config, key+"="+nixConfig[key])
+	}
+
+	return config
+}
+
 func mkOptionsFromHost(host Host) []string {
 	return mkOptions(host.NixConfig)
 }
@@ -449,6 +594,16 @@ func mkOptions(nixConfig map[string]string) []string {
 	return options
 }
 
+// Where the result of the latest build is kept with --keep-result. For flakes, it's named after the flake output.
+func GCRootPath(deploymentPath string) string {
+	if ref, ok := ParseFlakeRef(deploymentPath); ok {
+		dir, _ := DeploymentDir(deploymentPath)
+		return filepath.Join(dir, ".gcroots", ref.Attr)
+	}
+
+	return filepath.Join(path.Dir(deploymentPath), ".gcroots", path.Base(deploymentPath))
+}
+
 func GetNixSystemPath(host Host, resultPath string) (string, error) {
 	return os.Readlink(filepath.Join(resultPath, host.Name))
 }
@@ -464,13 +619,11 @@ func GetPathsToPush(host Host, resultPath string) (paths []string, err error) {
 	return paths, nil
 }
 
-func Push(sshContext *ssh.SSHContext, host Host, paths ...string) (err error) {
-	utils.ValidateEnvironment("ssh")
-
+// The nix-copy-closure commands for pushing paths to the host, along with the extra environment they need
+func pushCmds(sshContext *ssh.SSHContext, host Host, paths ...string) (cmds []*exec.Cmd, extraEnv []string) {
 	var userArg = ""
 	var keyArg = ""
 	var sshOpts = []string{}
-	var env = os.Environ()
 	if host.TargetUser != "" {
 		userArg = host.TargetUser + "@"
 	} else if sshContext.DefaultUsername != "" {
@@ -489,7 +642,7 @@ func Push(sshContext *ssh.SSHContext, host Host, paths ...string) (err error) {
 		sshOpts = append(sshOpts, fmt.Sprintf("-F %s", sshContext.ConfigFile))
 	}
 	if len(sshOpts) > 0 {
-		env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", strings.Join(sshOpts, " ")))
+		extraEnv = append(extraEnv, fmt.Sprintf("NIX_SSHOPTS=%s", strings.Join(sshOpts, " ")))
 	}
 
 	options := mkOptionsFromHost(host)
@@ -503,13 +656,21 @@ func Push(sshContext *ssh.SSHContext, host Host, paths ...string) (err error) {
 			args = append(args, "--use-substitutes")
 		}
 
-		cmd := exec.Command(
-			"nix-copy-closure", args...,
-		)
-		cmd.Env = env
+		cmds = append(cmds, exec.Command("nix-copy-closure", args...))
+	}
+
+	return cmds, extraEnv
+}
+
+func Push(sshContext *ssh.SSHContext, host Host, paths ...string) (err error) {
+	utils.ValidateEnvironment("ssh")
+
+	cmds, extraEnv := pushCmds(sshContext, host, paths...)
+	for _, cmd := range cmds {
+		cmd.Env = append(os.Environ(), extraEnv...)
 
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = sshContext.Output
+		cmd.Stderr = sshContext.Output
 		err = cmd.Run()
 
 		if err != nil {
@@ -520,10 +681,21 @@ func Push(sshContext *ssh.SSHContext, host Host, paths ...string) (err error) {
 	return nil
 }
 
+// The command lines Push would run
+func PushCommandLines(sshContext *ssh.SSHContext, host Host, paths ...string) (commands []string) {
+	cmds, extraEnv := pushCmds(sshContext, host, paths...)
+	for _, cmd := range cmds {
+		commands = append(commands, utils.ShellJoin(append(extraEnv, cmd.Args...)...))
+	}
+
+	return commands
+}
+
 func GetNixContext(opts *common.QuetzalOptions) *NixContext {
 	evalCmd := os.Getenv("QUETZAL_NIX_EVAL_CMD")
 	buildCmd := os.Getenv("QUETZAL_NIX_BUILD_CMD")
 	shellCmd := os.Getenv("QUETZAL_NIX_SHELL_CMD")
+	nixCmd := os.Getenv("QUETZAL_NIX_CMD")
 	evalMachines := os.Getenv("QUETZAL_NIX_EVAL_MACHINES")
 
 	if evalCmd == "" {
@@ -535,6 +707,9 @@ func GetNixContext(opts *common.QuetzalOptions) *NixContext {
 	if shellCmd == "" {
 		shellCmd = "nix-shell"
 	}
+	if nixCmd == "" {
+		nixCmd = "nix"
+	}
 	if evalMachines == "" {
 		evalMachines = filepath.Join(opts.AssetRoot, "eval-machines.nix")
 	}
@@ -547,5 +722,30 @@ func GetNixContext(opts *common.QuetzalOptions) *NixContext {
 		ShowTrace:       opts.ShowTrace,
 		KeepGCRoot:      *opts.KeepGCRoot,
 		AllowBuildShell: *opts.AllowBuildShell,
+		NixCmd:          nixCmd,
+		FlakeArgs:       flakeArgs(opts),
+		EvalCache:       !*opts.NoEvalCache,
+	}
+}
+
+// Lock file flags and input overrides for evaluating flakes, as given on the command line
+func flakeArgs(opts *common.QuetzalOptions) []string {
+	args := []string{}
+	if *opts.NoUpdateLockFile {
+		args = append(args, "--no-update-lock-file")
+	}
+	if *opts.NoWriteLockFile {
+		args = append(args, "--no-write-lock-file")
+	}
+
+	inputs := []string{}
+	for input := range *opts.OverrideInputs {
+		inputs = append(inputs, input)
 	}
+	sort.Strings(inputs)
+	for _, input := range inputs {
+		args = append(args, "--override-input", input, (*opts.OverrideInputs)[input])
+	}
+
+	return args
 }
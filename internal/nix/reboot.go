@@ -0,0 +1,129 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+// How long to wait for a host to come back from a reboot, unless set for the host or on the command line
+const DefaultRebootTimeout = 600
+
+// The phases of a host coming back from a reboot, in order
+type RebootPhase int
+
+const (
+	RebootPhaseRequested RebootPhase = iota
+	RebootPhaseDown
+	RebootPhasePortOpen
+	RebootPhaseSSH
+	RebootPhaseRebooted
+	RebootPhaseBooted
+)
+
+var rebootPhases = []struct {
+	name        string
+	description string
+	// Why the host isn't coming back, when waiting gets stuck in the phase
+	stuck string
+}{
+	{"requested", "reboot requested", "the host didn't go down"},
+	{"down", "went down", "the host is down, and its SSH port doesn't accept connections"},
+	{"port-open", "SSH port open", "the SSH port accepts connections, but logging in fails"},
+	{"ssh", "SSH login works", "SSH works, but the host still has its old boot ID"},
+	{"rebooted", "new boot ID", "the host rebooted, but systemd didn't finish booting"},
+	{"booted", "booted", ""},
+}
+
+func (phase RebootPhase) String() string {
+	return rebootPhases[phase].name
+}
+
+// The reboot timeout from the command line if given, otherwise the one of the host
+func (host *Host) GetRebootTimeout(override int) time.Duration {
+	timeout := host.RebootTimeout
+	if override > 0 {
+		timeout = override
+	}
+	if timeout <= 0 {
+		timeout = DefaultRebootTimeout
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// Whether SSH got as far as authenticating, so the port is open even if it can't be reached directly, e.g. through a jump host
+func authFailed(err error) bool {
+	return strings.Contains(err.Error(), "Permission denied") || strings.Contains(err.Error(), "Host key verification failed")
+}
+
+/*
+Wait for the host to come back with a new boot ID, and for systemd to finish booting ("running" or "degraded"), so
+health checks don't start while services are still starting. Gives up after the timeout, saying which phase the host
+got stuck in.
+*/
+func (host *Host) waitForReboot(sshContext *ssh.SSHContext, oldBootID string, timeout time.Duration) error {
+	phase := RebootPhaseRequested
+	advance := func(to RebootPhase) {
+		for ; phase < to; phase++ {
+			next := phase + 1
+			events.Publish(events.RebootPhaseReached{Host: host.Name, Phase: next.String(), Description: rebootPhases[next].description})
+		}
+	}
+
+	var (
+		lastErr     error
+		systemState string
+	)
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		events.Publish(events.RebootWaiting{Host: host.Name, Attempt: attempt})
+
+		bootID, state, err := sshContext.GetBootState(host)
+		switch {
+		case err != nil:
+			lastErr = err
+			advance(RebootPhaseDown)
+			if authFailed(err) || ssh.PortOpen(host) {
+				advance(RebootPhasePortOpen)
+			}
+
+		case bootID == "" || bootID == oldBootID:
+			// Still the old boot. If the connection failed in between, it was lost without the host rebooting.
+			lastErr = nil
+			if phase >= RebootPhaseDown {
+				advance(RebootPhaseSSH)
+			}
+
+		default:
+			if phase < RebootPhaseRebooted {
+				advance(RebootPhaseSSH)
+				events.Publish(events.RebootDetected{Host: host.Name, OldBootID: oldBootID, NewBootID: bootID})
+				advance(RebootPhaseRebooted)
+			}
+
+			// Without systemctl there's nothing more to wait for
+			systemState = state
+			if state == "" || state == "running" || state == "degraded" {
+				advance(RebootPhaseBooted)
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			message := fmt.Sprintf("%s didn't come back within %s after rebooting: %s", host.Name, timeout, rebootPhases[phase].stuck)
+			if phase == RebootPhaseRebooted {
+				message += fmt.Sprintf(" (systemd is %s)", systemState)
+			} else if lastErr != nil {
+				message += fmt.Sprintf(" (%s)", lastErr.Error())
+			}
+			return errors.New(message)
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,96 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/quetzal-deploy/quetzal/internal/diff"
+	"github.com/quetzal-deploy/quetzal/internal/ssh"
+)
+
+// Symlinks in a NixOS system pointing to the parts that need a reboot to take effect
+var systemLinks = []string{"kernel", "initrd", "kernel-modules", "systemd"}
+
+func systemInfo(systemPath string, links []string, kernelParams string, units map[string]string) *diff.SystemInfo {
+	return &diff.SystemInfo{
+		Path:          systemPath,
+		Kernel:        links[0],
+		Initrd:        links[1],
+		KernelModules: links[2],
+		Systemd:       links[3],
+		KernelParams:  strings.TrimSpace(kernelParams),
+		Units:         units,
+	}
+}
+
+// Inspect a system on the host, or in the local store if host is nil
+func GetSystemInfo(sshContext *ssh.SSHContext, host *Host, systemPath string) (*diff.SystemInfo, error) {
+	if host == nil {
+		return getLocalSystemInfo(systemPath)
+	}
+
+	args := []string{"readlink", "-m"}
+	for _, link := range systemLinks {
+		args = append(args, filepath.Join(systemPath, link))
+	}
+	output, err := runOn(sshContext, host, args...)
+	if err != nil {
+		return nil, err
+	}
+	links := strings.Split(strings.TrimSpace(output), "\n")
+	for len(links) < len(systemLinks) {
+		links = append(links, "")
+	}
+
+	// Not all systems have kernel parameters, e.g. containers
+	kernelParams, _ := runOn(sshContext, host, "cat", filepath.Join(systemPath, "kernel-params"))
+
+	// The format is quoted for the remote shell
+	output, err = runOn(sshContext, host, "find", filepath.Join(systemPath, "etc/systemd/system")+"/",
+		"-mindepth", "1", "-maxdepth", "1", "-not", "-type", "d", "-printf", `'%f %l\n'`)
+	if err != nil {
+		return nil, err
+	}
+	units := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if name, target, ok := strings.Cut(line, " "); ok {
+			units[name] = target
+		}
+	}
+
+	return systemInfo(systemPath, links, kernelParams, units), nil
+}
+
+func getLocalSystemInfo(systemPath string) (*diff.SystemInfo, error) {
+	links := []string{}
+	for _, link := range systemLinks {
+		path := filepath.Join(systemPath, link)
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			// like `readlink -m`, resolve as much as possible
+			if target, err = os.Readlink(path); err != nil {
+				target = path
+			}
+		}
+		links = append(links, target)
+	}
+
+	kernelParams, _ := os.ReadFile(filepath.Join(systemPath, "kernel-params"))
+
+	unitsDir := filepath.Join(systemPath, "etc/systemd/system")
+	entries, err := os.ReadDir(unitsDir)
+	if err != nil {
+		return nil, err
+	}
+	units := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		target, _ := os.Readlink(filepath.Join(unitsDir, entry.Name()))
+		units[entry.Name()] = target
+	}
+
+	return systemInfo(systemPath, links, string(kernelParams), units), nil
+}
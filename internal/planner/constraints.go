@@ -0,0 +1,36 @@
+package planner
+
+import (
+	"github.com/quetzal-deploy/quetzal/internal/constraints"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+)
+
+// Resolve constraint expressions for a list of hosts
+func ResolveConstraints(constraintExprs []string, hosts []nix.Host) (*constraints.Graph, error) {
+	parsedConstraints, err := constraints.Parse(constraintExprs)
+	if err != nil {
+		return nil, err
+	}
+
+	constraintHosts := make([]constraints.Host, len(hosts))
+	for i := range hosts {
+		constraintHosts[i] = &hosts[i]
+	}
+
+	return parsedConstraints.Resolve(constraintHosts)
+}
+
+// Sort hosts in the order they will be handled in, according to the constraints
+func SortHosts(constraintExprs []string, hosts []nix.Host) ([]nix.Host, error) {
+	graph, err := ResolveConstraints(constraintExprs, hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	sortedHosts := make([]nix.Host, 0, len(hosts))
+	for _, i := range graph.Order() {
+		sortedHosts = append(sortedHosts, hosts[i])
+	}
+
+	return sortedHosts, nil
+}
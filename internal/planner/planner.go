@@ -0,0 +1,399 @@
+package planner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/hooks"
+	"github.com/quetzal-deploy/quetzal/internal/nix"
+)
+
+type StepType string
+
+const (
+	StepBuild           StepType = "build"
+	StepPush            StepType = "push"
+	StepUploadSecrets   StepType = "upload-secrets"
+	StepPreDeployChecks StepType = "pre-deploy-checks"
+	StepActivate        StepType = "activate"
+	StepReboot          StepType = "reboot"
+	StepHealthChecks    StepType = "health-checks"
+	StepDiff            StepType = "diff"
+	StepHook            StepType = "hook"
+	StepConfirm         StepType = "confirm"
+)
+
+type Step struct {
+	ID          string   `json:"id"`
+	Type        StepType `json:"type"`
+	Host        string   `json:"host,omitempty"`
+	Description string   `json:"description"`
+	DependsOn   []string `json:"dependsOn"`
+
+	// Secrets upload phase, empty means all phases. For hooks: the kind of hooks to run.
+	Phase        string `json:"phase,omitempty"`
+	SwitchAction string `json:"switchAction,omitempty"`
+	// For activation: remember the current configuration. For health checks: roll back to it if the checks fail.
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
+	// For reboots: only reboot if the new system changes something loaded at boot
+	OnlyIfNeeded bool `json:"onlyIfNeeded,omitempty"`
+	// Only show the commands the step would execute
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// A dependency graph of the steps needed to carry out a command.
+// Steps are stored in an order where each step comes after all of its dependencies.
+type Plan struct {
+	Command      string `json:"command"`
+	SwitchAction string `json:"switchAction,omitempty"`
+	DryRun       bool   `json:"dryRun,omitempty"`
+	// Failing hosts don't stop the other hosts, except those ordered after them by the constraints
+	KeepGoing   bool              `json:"keepGoing,omitempty"`
+	Parallel    int               `json:"parallel"`
+	Constraints []string          `json:"constraints"`
+	Hosts       []string          `json:"hosts"`
+	Skipped     map[string]string `json:"skipped,omitempty"`
+	Steps       []*Step           `json:"steps"`
+}
+
+func newPlan(command string, opts *common.QuetzalOptions, hosts []nix.Host, parallel int) *Plan {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	plan := &Plan{
+		Command:     command,
+		DryRun:      *opts.DryRun,
+		Parallel:    parallel,
+		Constraints: append([]string{}, opts.Constraints...),
+		Hosts:       []string{},
+		Skipped:     make(map[string]string),
+		Steps:       []*Step{},
+	}
+
+	for _, host := range hosts {
+		plan.Hosts = append(plan.Hosts, host.Name)
+	}
+
+	return plan
+}
+
+func newHostStep(host nix.Host, stepType StepType, phase string, description string) *Step {
+	id := host.Name + ":" + string(stepType)
+	if phase != "" {
+		id += ":" + phase
+	}
+
+	return &Step{
+		ID:          id,
+		Type:        stepType,
+		Host:        host.Name,
+		Description: description,
+		DependsOn:   []string{},
+		Phase:       phase,
+	}
+}
+
+func targetDescription(host nix.Host) string {
+	if host.TargetUser != "" {
+		return fmt.Sprintf("%s (%s@%s)", host.Name, host.TargetUser, host.TargetHost)
+	}
+	return fmt.Sprintf("%s (%s)", host.Name, host.TargetHost)
+}
+
+// Add a chain of steps for each host. The first step of each host depends on `after` (if any), and on the last step of
+// every host it has to wait for according to the constraints.
+func (plan *Plan) addHostChains(hosts []nix.Host, after *Step, skipReason string, stepsFor func(host nix.Host) []*Step) error {
+	graph, err := ResolveConstraints(plan.Constraints, hosts)
+	if err != nil {
+		return err
+	}
+
+	lastSteps := make([]*Step, len(hosts))
+	for _, i := range graph.Order() {
+		host := hosts[i]
+		if host.BuildOnly {
+			plan.Skipped[host.Name] = skipReason
+			continue
+		}
+
+		steps := stepsFor(host)
+		if len(steps) == 0 {
+			continue
+		}
+
+		first := steps[0]
+		if after != nil {
+			first.DependsOn = append(first.DependsOn, after.ID)
+		}
+		// graph.Order() makes sure the hosts this host depends on have already been added
+		for _, dep := range graph.Dependencies(i) {
+			if lastSteps[dep] != nil {
+				first.DependsOn = append(first.DependsOn, lastSteps[dep].ID)
+			}
+		}
+		for k := 1; k < len(steps); k++ {
+			steps[k].DependsOn = append(steps[k].DependsOn, steps[k-1].ID)
+		}
+
+		plan.Steps = append(plan.Steps, steps...)
+		lastSteps[i] = steps[len(steps)-1]
+	}
+
+	return nil
+}
+
+func (plan *Plan) addBuildStep(hosts []nix.Host) *Step {
+	step := &Step{
+		ID:          string(StepBuild),
+		Type:        StepBuild,
+		Description: fmt.Sprintf("Build configuration for %d host(s)", len(hosts)),
+		DependsOn:   []string{},
+	}
+	plan.Steps = append(plan.Steps, step)
+
+	return step
+}
+
+// Ask before changing any hosts, unless told not to. Nothing changes on a dry run, so there's nothing to ask about.
+// Returns the last global step for the hosts to depend on.
+func (plan *Plan) addConfirmStep(opts *common.QuetzalOptions, after *Step) *Step {
+	if plan.DryRun || opts.Yes {
+		return after
+	}
+
+	step := &Step{
+		ID:          string(StepConfirm),
+		Type:        StepConfirm,
+		Description: "Show the hosts about to be changed, and ask for confirmation",
+		DependsOn:   []string{},
+	}
+	if after != nil {
+		step.DependsOn = append(step.DependsOn, after.ID)
+	}
+	plan.Steps = append(plan.Steps, step)
+
+	return step
+}
+
+// A step which only shows its commands when doing a dry run
+func (plan *Plan) newHostStep(host nix.Host, stepType StepType, phase string, description string) *Step {
+	step := newHostStep(host, stepType, phase, description)
+	step.DryRun = plan.DryRun
+	return step
+}
+
+// Run the hooks of the host for the phase locally, if it has any
+func (plan *Plan) hookSteps(host nix.Host, phase string) []*Step {
+	if len(host.Hooks.ForPhase(phase)) == 0 {
+		return nil
+	}
+	return []*Step{plan.newHostStep(host, StepHook, phase, fmt.Sprintf("Run %s hooks for %s locally", phase, host.Name))}
+}
+
+// When doing a dry run, compare the system running on the host with the new build before anything else
+func (plan *Plan) diffSteps(host nix.Host) []*Step {
+	if !plan.DryRun {
+		return nil
+	}
+	return []*Step{newHostStep(host, StepDiff, "", "Compare the system running on "+host.Name+" with the new build")}
+}
+
+func PlanDeploy(opts *common.QuetzalOptions, hosts []nix.Host) (*Plan, error) {
+	doPush := false
+	doUploadSecrets := false
+	doActivate := false
+
+	switch opts.DeploySwitchAction {
+	case "dry-activate":
+		doPush = true
+		doActivate = true
+	case "test":
+		fallthrough
+	case "switch":
+		fallthrough
+	case "boot":
+		doPush = true
+		doUploadSecrets = opts.DeployUploadSecrets
+		doActivate = true
+	}
+
+	// Checks are pointless when nothing changes on the hosts
+	doChecks := !*opts.DryRun
+
+	// Nothing has changed on a host after dry-activate, so there's nothing to roll back
+	rollback := doActivate && doChecks && opts.RollbackOnFailure && opts.DeploySwitchAction != "dry-activate"
+
+	plan := newPlan("deploy", opts, hosts, opts.Parallel)
+	plan.SwitchAction = opts.DeploySwitchAction
+	plan.KeepGoing = opts.KeepGoing
+
+	build := plan.addBuildStep(hosts)
+	confirm := plan.addConfirmStep(opts, build)
+
+	err := plan.addHostChains(hosts, confirm, "Deployment steps are disabled for build-only host", func(host nix.Host) (steps []*Step) {
+		steps = append(steps, plan.diffSteps(host)...)
+
+		if doPush {
+			steps = append(steps, plan.newHostStep(host, StepPush, "", "Push system closure to "+targetDescription(host)))
+		}
+
+		if doUploadSecrets {
+			steps = append(steps, plan.newHostStep(host, StepUploadSecrets, "pre-activation", "Upload pre-activation secrets to "+targetDescription(host)))
+			if !opts.SkipHealthChecks && doChecks {
+				steps = append(steps, newHostStep(host, StepHealthChecks, "pre-activation", "Run health checks on "+host.Name+" after uploading secrets"))
+			}
+		}
+
+		if !opts.SkipPreDeployChecks && doChecks {
+			steps = append(steps, newHostStep(host, StepPreDeployChecks, "", "Run pre-deploy checks on "+host.Name))
+		}
+
+		if doActivate {
+			steps = append(steps, plan.hookSteps(host, hooks.PreDeploy)...)
+
+			step := plan.newHostStep(host, StepActivate, "", fmt.Sprintf("Run '%s' on %s", opts.DeploySwitchAction, host.Name))
+			step.SwitchAction = opts.DeploySwitchAction
+			step.RollbackOnFailure = rollback
+			steps = append(steps, step)
+
+			steps = append(steps, plan.hookSteps(host, hooks.PostActivate)...)
+		}
+
+		if opts.DeployReboot != "" {
+			step := plan.newHostStep(host, StepReboot, "", "Reboot "+host.Name+" and wait for it to come back online")
+			if opts.DeployReboot == "auto" {
+				step.Description += ", if something loaded at boot changed"
+				step.OnlyIfNeeded = true
+			}
+			steps = append(steps, step)
+		}
+
+		if doUploadSecrets {
+			steps = append(steps, plan.newHostStep(host, StepUploadSecrets, "post-activation", "Upload post-activation secrets to "+targetDescription(host)))
+		}
+
+		if !opts.SkipHealthChecks && doChecks {
+			description := "Run health checks on " + host.Name
+			if rollback {
+				description += ", rolling back on failure"
+			}
+			step := newHostStep(host, StepHealthChecks, "", description)
+			step.RollbackOnFailure = rollback
+			steps = append(steps, step)
+		}
+
+		if doActivate {
+			steps = append(steps, plan.hookSteps(host, hooks.PostHealthCheck)...)
+		}
+
+		return steps
+	})
+
+	return plan, err
+}
+
+func PlanPush(opts *common.QuetzalOptions, hosts []nix.Host) (*Plan, error) {
+	plan := newPlan("push", opts, hosts, 1)
+
+	build := plan.addBuildStep(hosts)
+
+	err := plan.addHostChains(hosts, build, "Push is disabled for build-only host", func(host nix.Host) []*Step {
+		return append(plan.diffSteps(host), plan.newHostStep(host, StepPush, "", "Push system closure to "+targetDescription(host)))
+	})
+
+	return plan, err
+}
+
+func PlanUploadSecrets(opts *common.QuetzalOptions, hosts []nix.Host) (*Plan, error) {
+	plan := newPlan("upload-secrets", opts, hosts, 1)
+
+	confirm := plan.addConfirmStep(opts, nil)
+
+	err := plan.addHostChains(hosts, confirm, "Secret upload is disabled for build-only host", func(host nix.Host) (steps []*Step) {
+		steps = append(steps, plan.newHostStep(host, StepUploadSecrets, "", "Upload secrets to "+targetDescription(host)))
+		if !opts.SkipHealthChecks && !plan.DryRun {
+			steps = append(steps, newHostStep(host, StepHealthChecks, "", "Run health checks on "+host.Name))
+		}
+		return steps
+	})
+
+	return plan, err
+}
+
+// Steps that aren't tied to a specific host, e.g. building
+func (plan *Plan) GlobalSteps() (steps []*Step) {
+	for _, step := range plan.Steps {
+		if step.Host == "" {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+func (plan *Plan) HostSteps(hostName string) (steps []*Step) {
+	for _, step := range plan.Steps {
+		if step.Host == hostName {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+func (plan *Plan) Print(w io.Writer) {
+	action := plan.Command
+	if plan.SwitchAction != "" {
+		action += " " + plan.SwitchAction
+	}
+	if plan.DryRun {
+		action += " (dry run)"
+	}
+	fmt.Fprintf(w, "Plan for '%s' on %d host(s), at most %d host(s) at a time:\n", action, len(plan.Hosts), plan.Parallel)
+	if plan.KeepGoing {
+		fmt.Fprintln(w, "Failing hosts don't stop the other hosts")
+	}
+
+	if len(plan.Constraints) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Constraints:")
+		for _, constraint := range plan.Constraints {
+			fmt.Fprintf(w, "\t* %s\n", constraint)
+		}
+	}
+
+	if len(plan.Skipped) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Skipped:")
+		for _, hostName := range plan.Hosts {
+			if reason, ok := plan.Skipped[hostName]; ok {
+				fmt.Fprintf(w, "\t* %s: %s\n", hostName, reason)
+			}
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Steps:")
+	for index, step := range plan.Steps {
+		description := step.Description
+		if step.DryRun {
+			description += " (only show commands)"
+		}
+		fmt.Fprintf(w, "\t%3d: %s - %s\n", index, step.ID, description)
+		if len(step.DependsOn) > 0 {
+			fmt.Fprintf(w, "\t     after: %s\n", strings.Join(step.DependsOn, ", "))
+		}
+	}
+}
+
+func (plan *Plan) PrintJson(w io.Writer) error {
+	jsonPlan, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", jsonPlan)
+
+	return nil
+}
@@ -0,0 +1,251 @@
+package report
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/events"
+)
+
+// Summary of a command, built from the events published while it ran
+type Report struct {
+	Command    string            `json:"command"`
+	Success    bool              `json:"success"`
+	Error      string            `json:"error,omitempty"`
+	StartTime  time.Time         `json:"startTime"`
+	EndTime    time.Time         `json:"endTime"`
+	Duration   time.Duration     `json:"duration"`
+	Build      *Build            `json:"build,omitempty"`
+	Eval       *Eval             `json:"eval,omitempty"`
+	Hosts      []*Host           `json:"hosts"`
+	RolledBack []events.Rollback `json:"rolledBack,omitempty"`
+}
+
+type Build struct {
+	ResultPath string `json:"resultPath,omitempty"`
+	// Store path of the system configuration of each host
+	Paths    map[string]string `json:"paths,omitempty"`
+	Duration time.Duration     `json:"duration"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type Eval struct {
+	Attribute string `json:"attribute"`
+	Value     string `json:"value"`
+}
+
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped"
+	// Only with --keep-going: the host had to wait for a host that failed
+	StatusNotStarted = "not-started"
+)
+
+type Host struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+	// Empty if nothing was done on the host, e.g. when only building
+	Status string `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Type of the step that failed
+	FailedStep string        `json:"failedStep,omitempty"`
+	StorePath  string        `json:"storePath,omitempty"`
+	Duration   time.Duration `json:"duration"`
+	Error      string        `json:"error,omitempty"`
+	Steps      []*Step       `json:"steps"`
+	Checks     []*Check      `json:"checks"`
+	Output     string        `json:"output,omitempty"`
+	// Only for dry runs
+	Changes        *events.HostChanges `json:"changes,omitempty"`
+	DryRunCommands []string            `json:"dryRunCommands,omitempty"`
+
+	started time.Time
+}
+
+type Step struct {
+	ID       string        `json:"id"`
+	Type     string        `json:"type"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// The outcome of a single check. Checks are retried until they pass, so only the last failure is kept.
+type Check struct {
+	Kind        string `json:"kind"`
+	Description string `json:"description"`
+	Passed      bool   `json:"passed"`
+	Attempts    int    `json:"attempts"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Builds a report from events. Add it as a subscriber before running the command, and call Finish when it's done.
+type Collector struct {
+	report       Report
+	hosts        map[string]*Host
+	buildStarted time.Time
+}
+
+func NewCollector(command string) *Collector {
+	return &Collector{
+		report: Report{
+			Command:   command,
+			StartTime: time.Now(),
+			Hosts:     []*Host{},
+		},
+		hosts: make(map[string]*Host),
+	}
+}
+
+func (c *Collector) host(name string) *Host {
+	host, ok := c.hosts[name]
+	if !ok {
+		host = &Host{Name: name, Tags: []string{}, Steps: []*Step{}, Checks: []*Check{}}
+		c.hosts[name] = host
+		c.report.Hosts = append(c.report.Hosts, host)
+	}
+	return host
+}
+
+func (c *Collector) Handle(record events.Record) {
+	switch e := record.Event.(type) {
+	case events.HostsSelected:
+		for _, selected := range e.Hosts {
+			c.host(selected.Name).Tags = selected.Tags
+		}
+
+	case events.BuildStarted:
+		c.report.Build = &Build{}
+		c.buildStarted = record.Time
+
+	case events.BuildFinished:
+		c.report.Build.ResultPath = e.ResultPath
+		c.report.Build.Paths = e.Paths
+		c.report.Build.Error = e.Error
+		c.report.Build.Duration = record.Time.Sub(c.buildStarted)
+		for name, path := range e.Paths {
+			c.host(name).StorePath = path
+		}
+
+	case events.Evaluated:
+		c.report.Eval = &Eval{Attribute: e.Attribute, Value: e.Value}
+
+	case events.RunFinished:
+		c.report.RolledBack = e.RolledBack
+		for _, outcome := range e.Summary {
+			host := c.host(outcome.Host)
+			host.FailedStep = outcome.FailedStep
+			if outcome.Status == StatusNotStarted {
+				host.Status = StatusNotStarted
+			}
+		}
+
+	case events.HostStarted:
+		host := c.host(e.Host)
+		host.Status = StatusRunning
+		host.started = record.Time
+
+	case events.HostFinished:
+		host := c.host(e.Host)
+		host.Duration = e.Duration
+		host.Error = e.Error
+		if e.Error != "" {
+			host.Status = StatusFailed
+		} else {
+			host.Status = StatusSucceeded
+		}
+
+	case events.HostSkipped:
+		host := c.host(e.Host)
+		host.Status = StatusSkipped
+		host.Reason = e.Reason
+
+	case events.StepStarted:
+		if e.Host != "" {
+			host := c.host(e.Host)
+			host.Steps = append(host.Steps, &Step{ID: e.Step, Type: e.StepType, Status: StatusRunning})
+		}
+
+	case events.StepFinished:
+		if e.Host != "" {
+			for _, step := range c.host(e.Host).Steps {
+				if step.ID == e.Step {
+					step.Duration = e.Duration
+					step.Error = e.Error
+					if e.Error != "" {
+						step.Status = StatusFailed
+					} else {
+						step.Status = StatusSucceeded
+					}
+				}
+			}
+		}
+
+	case events.CheckPassed:
+		check := c.check(e.Host, e.Kind, e.Description)
+		check.Attempts++
+		check.Passed = true
+		check.Error = ""
+
+	case events.CheckFailed:
+		check := c.check(e.Host, e.Kind, e.Description)
+		check.Attempts++
+		check.Error = e.Error
+
+	case events.HostChanges:
+		c.host(e.Host).Changes = &e
+
+	case events.DryRunCommand:
+		host := c.host(e.Host)
+		host.DryRunCommands = append(host.DryRunCommands, e.Command)
+
+	case events.Output:
+		if e.Host != "" {
+			c.host(e.Host).Output += e.Text
+		}
+	}
+}
+
+func (c *Collector) check(hostName string, kind string, description string) *Check {
+	host := c.host(hostName)
+	for _, check := range host.Checks {
+		if check.Kind == kind && check.Description == description {
+			return check
+		}
+	}
+
+	check := &Check{Kind: kind, Description: description}
+	host.Checks = append(host.Checks, check)
+	return check
+}
+
+// Complete the report with the outcome of the command
+func (c *Collector) Finish(err error) *Report {
+	c.report.EndTime = time.Now()
+	c.report.Duration = c.report.EndTime.Sub(c.report.StartTime)
+	c.report.Success = err == nil
+	c.report.Error = events.ErrorString(err)
+
+	// Hosts still running were interrupted by the error
+	for _, host := range c.report.Hosts {
+		if host.Status == StatusRunning {
+			host.Status = StatusFailed
+			host.Duration = c.report.EndTime.Sub(host.started)
+		}
+	}
+
+	return &c.report
+}
+
+func (report *Report) PrintJson(w io.Writer) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
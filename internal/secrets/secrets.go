@@ -86,3 +86,25 @@ func UploadSecret(sshContext *ssh.SSHContext, host ssh.Host, secret Secret, depl
 
 	return partialErr
 }
+
+// The command lines UploadSecret would run. The name of the temporary file is only known when uploading.
+func UploadCommandLines(sshContext *ssh.SSHContext, host ssh.Host, secret Secret, deploymentWD string) (commands []string) {
+	const tempPath = "<temporary file>"
+
+	commandLine := func(parts ...string) {
+		command, _ := sshContext.CommandLine(host, parts...)
+		commands = append(commands, command)
+	}
+
+	commandLine("sudo", "/run/current-system/sw/bin/systemd-run", "--collect", "--wait", "--property=RequiresMountsFor="+secret.Destination, "true")
+	commandLine("mktemp")
+	if secret.MkDirs {
+		commandLine("sudo", "mkdir", "-p", "-m", "755", filepath.Dir(secret.Destination))
+	}
+	commands = append(commands, sshContext.UploadCommandLine(host, utils.GetAbsPathRelativeTo(secret.Source, deploymentWD), tempPath))
+	commandLine("sudo", "mv", tempPath, secret.Destination)
+	commandLine("sudo", "chown", secret.Owner.User+":"+secret.Owner.Group, secret.Destination)
+	commandLine("sudo", "chmod", secret.Permissions, secret.Destination)
+
+	return commands
+}
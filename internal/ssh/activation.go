@@ -0,0 +1,285 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/utils"
+)
+
+// Detached activations keep their output and outcome here, so they can be followed across connections
+var activationsDir = filepath.Join(StateDir, "activations")
+
+const (
+	activationPollInterval = time.Second
+	// Each attempt at following a detached activation gives up after this, so a hanging connection is noticed
+	activationPollTimeout = 15 * time.Second
+	// How long to keep trying to reach a host after losing the connection during a detached activation
+	activationReconnectTimeout = 5 * time.Minute
+)
+
+// A detached activation: switch-to-configuration running in a transient systemd unit on the host
+type detachedActivation struct {
+	id             string
+	configuration  string
+	action         string
+	confirmTimeout int
+}
+
+func (activation *detachedActivation) unit() string {
+	return "quetzal-activation-" + activation.id
+}
+
+func (activation *detachedActivation) file(suffix string) string {
+	return filepath.Join(activationsDir, activation.id+"."+suffix)
+}
+
+// Only switch and test change what's running, so the connection can only be lost with those
+func (activation *detachedActivation) deadManSwitch() bool {
+	return activation.confirmTimeout > 0 && (activation.action == "switch" || activation.action == "test")
+}
+
+/*
+The script run by the transient unit. It records the system running before activation, activates, and records the exit
+status. With a dead man's switch it then waits for Quetzal to confirm that the host can still be reached. Whoever
+creates the "decided" directory first wins: Quetzal confirming, or the host rolling back to the previous system. The
+winner records itself in the directory, so Quetzal can tell who won even if it lost the connection while confirming.
+*/
+func (activation *detachedActivation) script() string {
+	lines := []string{
+		"PATH=/run/current-system/sw/bin:$PATH",
+		fmt.Sprintf("previous=$(readlink -f %s)", CurrentSystem),
+		fmt.Sprintf(`echo "$previous" > %s`, activation.file("previous")),
+		fmt.Sprintf("%s > %s 2>&1", utils.ShellJoin(switchArgs(activation.configuration, activation.action)...), activation.file("log")),
+		"status=$?",
+		fmt.Sprintf("echo $status > %s", activation.file("status")),
+	}
+
+	if activation.deadManSwitch() {
+		var rollback []string
+		if activation.action == "switch" {
+			rollback = append(rollback, fmt.Sprintf(`nix-env --profile %s --set "$previous" >> %s 2>&1`, SystemProfile, activation.file("log")))
+		}
+		rollback = append(rollback,
+			fmt.Sprintf(`"$previous/bin/switch-to-configuration" %s >> %s 2>&1`, activation.action, activation.file("log")),
+			fmt.Sprintf("echo $? > %s", activation.file("rolledback")),
+		)
+
+		lines = append(lines,
+			fmt.Sprintf("i=0; while [ $i -lt %d ] && [ ! -d %s ]; do sleep 1; i=$((i+1)); done", activation.confirmTimeout, activation.file("decided")),
+			fmt.Sprintf("if mkdir %s 2>/dev/null; then", activation.file("decided")),
+			fmt.Sprintf("  touch %s", filepath.Join(activation.file("decided"), "rollback")),
+			fmt.Sprintf(`  echo "Not confirmed within %d seconds, rolling back to $previous" >> %s`, activation.confirmTimeout, activation.file("log")),
+			"  "+strings.Join(rollback, "\n  "),
+			"fi",
+		)
+	}
+
+	return strings.Join(append(lines, "exit $status"), "\n")
+}
+
+func (activation *detachedActivation) launchArgs() []string {
+	launch := fmt.Sprintf("mkdir -p %s && systemd-run --unit=%s --description=%s --collect --no-block --quiet -- /bin/sh -c %s",
+		activationsDir, activation.unit(), utils.ShellJoin("Quetzal activation of "+activation.configuration), utils.ShellJoin(activation.script()))
+	return []string{"sh", "-c", utils.ShellJoin(launch)}
+}
+
+// The state of a detached activation, as seen by polling the host
+type activationState struct {
+	// Empty while still activating
+	status     string
+	rolledBack string
+	// Who won the race for the decision: "confirmed", "rollback", or "decided" while the winner is recording itself
+	decided string
+	// Output of the activation after the offset polled from
+	output string
+}
+
+func (sshContext *SSHContext) pollActivation(host Host, activation *detachedActivation, offset int) (*activationState, error) {
+	poll := fmt.Sprintf(
+		"echo \"$(cat %s 2>/dev/null) $(cat %s 2>/dev/null) $(%s)\"; tail -c +%d %s 2>/dev/null; true",
+		activation.file("status"), activation.file("rolledback"), activation.decision(), offset+1, activation.file("log"))
+
+	ctx, cancel := context.WithTimeout(context.TODO(), activationPollTimeout)
+	defer cancel()
+
+	cmd, err := sshContext.SudoCmdContext(ctx, host, "sh", "-c", utils.ShellJoin(poll))
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err = cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	header, output, _ := strings.Cut(stdout.String(), "\n")
+	fields := strings.Fields(header)
+	state := &activationState{output: output}
+	for _, field := range fields {
+		switch {
+		case field == "decided" || field == "confirmed" || field == "rollback":
+			state.decided = field
+		case state.status == "":
+			state.status = field
+		default:
+			state.rolledBack = field
+		}
+	}
+
+	return state, nil
+}
+
+// A shell command printing who decided the outcome of the activation, if anyone has, see activationState
+func (activation *detachedActivation) decision() string {
+	decided := activation.file("decided")
+	return fmt.Sprintf("if [ -e %s ]; then echo confirmed; elif [ -e %s ]; then echo rollback; elif [ -d %s ]; then echo decided; fi",
+		filepath.Join(decided, "confirmed"), filepath.Join(decided, "rollback"), decided)
+}
+
+// Tell the host it can still be reached, so it keeps the new configuration, unless it has decided to roll back.
+// Returns who decided, like activationState.
+func (sshContext *SSHContext) confirmActivation(host Host, activation *detachedActivation) (decision string, err error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), activationPollTimeout)
+	defer cancel()
+
+	confirm := fmt.Sprintf("if mkdir %s 2>/dev/null; then touch %s; fi; %s",
+		activation.file("decided"), filepath.Join(activation.file("decided"), "confirmed"), activation.decision())
+	cmd, err := sshContext.SudoCmdContext(ctx, host, "sh", "-c", utils.ShellJoin(confirm))
+	if err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err = cmd.Run(); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (activation *detachedActivation) rollbackError(host Host, state *activationState) error {
+	if state.rolledBack != "" && state.rolledBack != "0" {
+		return errors.New(fmt.Sprintf("The activation on %s wasn't confirmed within %d seconds, and rolling back failed. See %s on the host.", host.GetName(), activation.confirmTimeout, activation.file("log")))
+	}
+
+	return errors.New(fmt.Sprintf("%s rolled back to its previous system, since the activation wasn't confirmed within %d seconds", host.GetName(), activation.confirmTimeout))
+}
+
+/*
+Activate in a transient systemd unit, so the activation isn't interrupted if it breaks the connection, e.g. by changing
+the network or sshd. The output is followed by polling the host, reconnecting as needed.
+*/
+func (sshContext *SSHContext) activateDetached(host Host, configuration string, action string) error {
+	// the random part keeps activations started within the same second apart
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	activation := &detachedActivation{
+		id:             time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix),
+		configuration:  configuration,
+		action:         action,
+		confirmTimeout: sshContext.ConfirmTimeout,
+	}
+
+	cmd, err := sshContext.SudoCmd(host, activation.launchArgs()...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = sshContext.Output
+	cmd.Stderr = sshContext.Output
+	if err = cmd.Run(); err != nil {
+		return errors.New(fmt.Sprintf("Couldn't start the activation unit on %s: %s", host.GetName(), err.Error()))
+	}
+
+	events.Publish(events.Log{Host: host.GetName(), Message: fmt.Sprintf("Activating in unit %s on %s", activation.unit(), host.GetName())})
+
+	offset := 0
+	lastContact := time.Now()
+	disconnected := false
+	confirmed := false
+	var undecidedSince time.Time
+	for {
+		state, err := sshContext.pollActivation(host, activation, offset)
+		if err != nil {
+			if !disconnected {
+				disconnected = true
+				events.Publish(events.Log{Host: host.GetName(), Message: fmt.Sprintf("Lost the connection to %s, reconnecting: %s", host.GetName(), err.Error())})
+			}
+			if time.Since(lastContact) > activationReconnectTimeout {
+				message := fmt.Sprintf("Couldn't reach %s for %s during activation. The activation continues on the host, see `journalctl -u %s`.", host.GetName(), activationReconnectTimeout, activation.unit())
+				if activation.deadManSwitch() {
+					message += fmt.Sprintf(" Unless confirmed, the host rolls back within %d seconds after activating.", activation.confirmTimeout)
+				}
+				return errors.New(message)
+			}
+			time.Sleep(activationPollInterval * 2)
+			continue
+		}
+
+		if disconnected {
+			disconnected = false
+			events.Publish(events.Log{Host: host.GetName(), Message: "Reconnected to " + host.GetName()})
+		}
+		lastContact = time.Now()
+
+		fmt.Fprint(sshContext.Output, state.output)
+		offset += len(state.output)
+
+		if state.status == "" {
+			time.Sleep(activationPollInterval)
+			continue
+		}
+
+		if activation.deadManSwitch() && !confirmed {
+			switch {
+			case state.decided == "rollback" || state.rolledBack != "":
+				return activation.rollbackError(host, state)
+
+			case state.decided == "decided":
+				// the winner records itself right after deciding
+				if undecidedSince.IsZero() {
+					undecidedSince = time.Now()
+				}
+				if time.Since(undecidedSince) > activationPollTimeout {
+					return errors.New(fmt.Sprintf("Couldn't tell whether the activation on %s was confirmed, or rolled back. See %s on the host.", host.GetName(), activation.file("log")))
+				}
+				time.Sleep(activationPollInterval)
+				continue
+
+			case state.decided == "":
+				decision, err := sshContext.confirmActivation(host, activation)
+				if err != nil || decision == "" || decision == "decided" {
+					// the next poll finds out who won
+					time.Sleep(activationPollInterval)
+					continue
+				}
+				if decision == "rollback" {
+					return activation.rollbackError(host, state)
+				}
+			}
+
+			confirmed = true
+			events.Publish(events.Log{Host: host.GetName(), Message: "Confirmed the activation on " + host.GetName()})
+		}
+
+		if exitStatus, err := strconv.Atoi(state.status); err != nil || exitStatus != 0 {
+			return errors.New("Error while activating new configuration.")
+		}
+
+		return nil
+	}
+}
@@ -6,19 +6,31 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
 	"github.com/quetzal-deploy/quetzal/internal/utils"
 )
 
+const (
+	SystemProfile = "/nix/var/nix/profiles/system"
+	CurrentSystem = "/run/current-system"
+	BootedSystem  = "/run/booted-system"
+	// Where Quetzal keeps its own state on hosts
+	StateDir = "/var/lib/quetzal"
+)
+
 type Host interface {
 	GetName() string
 	GetTargetHost() string
@@ -27,26 +39,51 @@ type Host interface {
 }
 
 type SSHContext struct {
-	sudoPassword           string
+	sudo                   *sudoPassword
 	AskForSudoPassword     bool
 	GetSudoPasswordCommand string
 	DefaultUsername        string
 	IdentityFile           string
 	ConfigFile             string
 	SkipHostKeyCheck       bool
+	// Activate in a transient systemd unit on the host, see activateDetached
+	DetachActivation bool
+	// Seconds hosts wait for the activation to be confirmed before rolling back on their own, 0 to never roll back.
+	// Implies DetachActivation.
+	ConfirmTimeout int
+	// Output receives progress messages and output from remote commands
+	Output io.Writer
+}
+
+// The sudo password is shared between all copies of an SSHContext, so it's only asked for once,
+// even when multiple hosts are handled concurrently.
+type sudoPassword struct {
+	sync.Mutex
+	password string
 }
 
 func CreateSSHContext(opts *common.QuetzalOptions) *SSHContext {
 	return &SSHContext{
+		sudo:                   &sudoPassword{},
 		AskForSudoPassword:     opts.AskForSudoPasswd,
 		GetSudoPasswordCommand: opts.PassCmd,
 		IdentityFile:           os.Getenv("SSH_IDENTITY_FILE"),
 		DefaultUsername:        os.Getenv("SSH_USER"),
 		SkipHostKeyCheck:       os.Getenv("SSH_SKIP_HOST_KEY_CHECK") != "",
 		ConfigFile:             os.Getenv("SSH_CONFIG_FILE"),
+		DetachActivation:       opts.DetachActivation,
+		ConfirmTimeout:         opts.ConfirmTimeout,
+		Output:                 events.NewOutputWriter(""),
 	}
 }
 
+// Create a copy of the SSH context writing its output to another writer
+func (sshContext *SSHContext) WithOutput(output io.Writer) *SSHContext {
+	c := *sshContext
+	c.Output = output
+	return &c
+}
+
 type FileTransfer struct {
 	Source      string
 	Destination string
@@ -130,30 +167,25 @@ func (sshContext *SSHContext) SudoCmdContext(ctx context.Context, host Host, par
 		return nil, err
 	}
 
-	// ask for password if not done already
-	if sshContext.AskForSudoPassword && sshContext.sudoPassword == "" {
-		sshContext.sudoPassword, err = askForSudoPassword()
-		if err != nil {
-			return nil, err
-		}
-	} else if sshContext.GetSudoPasswordCommand != "" {
-		command := strings.Fields(sshContext.GetSudoPasswordCommand)
-		var argsArr = []string{}
-		for i, e := range command {
-			if i != 0 {
-				argsArr = append(argsArr, e)
-			}
-		}
-		passCmd := exec.Command(command[0], argsArr...)
+	sudoPassword, err := sshContext.getSudoPassword()
+	if err != nil {
+		return nil, err
+	}
 
-		passOut, err := passCmd.Output()
+	cmd, cmdArgs := sshContext.sudoArgs(host, sudoPassword != "", parts)
+
+	command := exec.CommandContext(ctx, cmd, cmdArgs...)
+	if sudoPassword != "" {
+		err := writeSudoPassword(command, sudoPassword)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		sshContext.sudoPassword = string(passOut)
 	}
+	return command, nil
+}
 
-	cmd, cmdArgs := sshContext.sshArgs(host, nil)
+func (sshContext *SSHContext) sudoArgs(host Host, withPassword bool, parts []string) (cmd string, cmdArgs []string) {
+	cmd, cmdArgs = sshContext.sshArgs(host, nil)
 
 	// normalize sudo
 	if parts[0] == "sudo" {
@@ -161,7 +193,7 @@ func (sshContext *SSHContext) SudoCmdContext(ctx context.Context, host Host, par
 	}
 	cmdArgs = append(cmdArgs, "sudo")
 
-	if sshContext.sudoPassword != "" {
+	if withPassword {
 		cmdArgs = append(cmdArgs, "-S")
 	} else {
 		// no password supplied; request non-interactive sudo, which will fail with an error if a password was required
@@ -171,14 +203,70 @@ func (sshContext *SSHContext) SudoCmdContext(ctx context.Context, host Host, par
 	cmdArgs = append(cmdArgs, "-p", "''", "-k", "--")
 	cmdArgs = append(cmdArgs, parts...)
 
-	command := exec.CommandContext(ctx, cmd, cmdArgs...)
-	if sshContext.sudoPassword != "" {
-		err := writeSudoPassword(command, sshContext.sudoPassword)
+	return cmd, cmdArgs
+}
+
+// The command line Cmd would run, for showing it without running it. No sudo password is asked for.
+func (sshContext *SSHContext) CommandLine(host Host, parts ...string) (string, error) {
+	var err error
+	if parts, err = valCommand(parts); err != nil {
+		return "", err
+	}
+
+	var (
+		cmd     string
+		cmdArgs []string
+	)
+	if parts[0] == "sudo" {
+		withPassword := sshContext.AskForSudoPassword || sshContext.GetSudoPasswordCommand != ""
+		cmd, cmdArgs = sshContext.sudoArgs(host, withPassword, parts)
+	} else {
+		cmd, cmdArgs = sshContext.sshArgs(host, nil)
+		cmdArgs = append(cmdArgs, parts...)
+	}
+
+	return utils.ShellJoin(append([]string{cmd}, cmdArgs...)...), nil
+}
+
+// The command line UploadFile would run
+func (sshContext *SSHContext) UploadCommandLine(host Host, source string, destination string) string {
+	cmd, cmdArgs := sshContext.sshArgs(host, &FileTransfer{
+		Source:      source,
+		Destination: destination,
+	})
+
+	return utils.ShellJoin(append([]string{cmd}, cmdArgs...)...)
+}
+
+func (sshContext *SSHContext) getSudoPassword() (string, error) {
+	sshContext.sudo.Lock()
+	defer sshContext.sudo.Unlock()
+
+	var err error
+	// ask for password if not done already
+	if sshContext.AskForSudoPassword && sshContext.sudo.password == "" {
+		sshContext.sudo.password, err = askForSudoPassword()
 		if err != nil {
-			return nil, err
+			return "", err
+		}
+	} else if sshContext.GetSudoPasswordCommand != "" {
+		command := strings.Fields(sshContext.GetSudoPasswordCommand)
+		var argsArr = []string{}
+		for i, e := range command {
+			if i != 0 {
+				argsArr = append(argsArr, e)
+			}
+		}
+		passCmd := exec.Command(command[0], argsArr...)
+
+		passOut, err := passCmd.Output()
+		if err != nil {
+			panic(err)
 		}
+		sshContext.sudo.password = string(passOut)
 	}
-	return command, nil
+
+	return sshContext.sudo.password, nil
 }
 
 func valCommand(parts []string) ([]string, error) {
@@ -190,29 +278,34 @@ func valCommand(parts []string) ([]string, error) {
 	return parts, nil
 }
 
-func (sshContext *SSHContext) CmdInteractive(host Host, timeout int, parts ...string) {
+// Run a command on the host with its output going to the output of the context. Failures are printed as well as
+// returned, so callers can choose to ignore them.
+func (sshContext *SSHContext) CmdInteractive(host Host, timeout int, parts ...string) error {
 	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), timeout)
 	defer cancel()
 
 	cmd, err := sshContext.CmdContext(ctx, host, parts...)
 	if err == nil {
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = sshContext.Output
+		cmd.Stderr = sshContext.Output
 		err = cmd.Run()
 	}
 
 	// context was cancelled
 	if ctx.Err() != nil {
-		fmt.Fprintf(os.Stderr, "Exec of cmd: %s timed out\n", parts)
-		return
+		fmt.Fprintf(sshContext.Output, "Exec of cmd: %s timed out\n", parts)
+		return ctx.Err()
 	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Exec of cmd: %s failed with err: '%s'\n", parts, err.Error())
+		fmt.Fprintf(sshContext.Output, "Exec of cmd: %s failed with err: '%s'\n", parts, err.Error())
 	}
+
+	return err
 }
 
 func askForSudoPassword() (string, error) {
+	events.Flush()
 	fmt.Fprint(os.Stderr, "Please enter remote sudo password: ")
 	stdin := int(syscall.Stdin)
 	state, err := terminal.GetState(stdin)
@@ -241,23 +334,35 @@ func writeSudoPassword(cmd *exec.Cmd, sudoPasswd string) (err error) {
 	return nil
 }
 
+func setProfileArgs(configuration string) []string {
+	return []string{"nix-env", "--profile", SystemProfile, "--set", configuration}
+}
+
+func switchArgs(configuration string, action string) []string {
+	return []string{filepath.Join(configuration, "bin/switch-to-configuration"), action}
+}
+
 func (sshContext *SSHContext) ActivateConfiguration(host Host, configuration string, action string) error {
 
 	if action == "switch" || action == "boot" {
-		cmd, err := sshContext.SudoCmd(host, "nix-env", "--profile", "/nix/var/nix/profiles/system", "--set", configuration)
+		cmd, err := sshContext.SudoCmd(host, setProfileArgs(configuration)...)
 		if err != nil {
 			return err
 		}
 
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = sshContext.Output
+		cmd.Stderr = sshContext.Output
 		err = cmd.Run()
 		if err != nil {
 			return err
 		}
 	}
 
-	args := []string{filepath.Join(configuration, "bin/switch-to-configuration"), action}
+	if sshContext.detached() {
+		return sshContext.activateDetached(host, configuration, action)
+	}
+
+	args := switchArgs(configuration, action)
 
 	var (
 		cmd *exec.Cmd
@@ -268,8 +373,8 @@ func (sshContext *SSHContext) ActivateConfiguration(host Host, configuration str
 		return err
 	}
 
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = sshContext.Output
+	cmd.Stderr = sshContext.Output
 	err = cmd.Run()
 	if err != nil {
 		return errors.New("Error while activating new configuration.")
@@ -278,6 +383,49 @@ func (sshContext *SSHContext) ActivateConfiguration(host Host, configuration str
 	return nil
 }
 
+func (sshContext *SSHContext) detached() bool {
+	return sshContext.DetachActivation || sshContext.ConfirmTimeout > 0
+}
+
+// The command lines ActivateConfiguration would run
+func (sshContext *SSHContext) ActivationCommandLines(host Host, configuration string, action string) (commands []string) {
+	if action == "switch" || action == "boot" {
+		command, _ := sshContext.CommandLine(host, append([]string{"sudo"}, setProfileArgs(configuration)...)...)
+		commands = append(commands, command)
+	}
+
+	args := switchArgs(configuration, action)
+	if sshContext.detached() {
+		args = (&detachedActivation{id: "<time>", configuration: configuration, action: action, confirmTimeout: sshContext.ConfirmTimeout}).launchArgs()
+	}
+	command, _ := sshContext.CommandLine(host, append([]string{"sudo"}, args...)...)
+	return append(commands, command)
+}
+
+// Resolve a symlink on the remote host, e.g. /run/current-system, to the store path it points to
+func (sshContext *SSHContext) ReadLink(host Host, path string) (string, error) {
+	cmd, err := sshContext.Cmd(host, "readlink", "-f", path)
+	if err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error on remote host %s (%s):\nCouldn't resolve %s\n\nOriginal error:\n%s",
+			host.GetName(), host.GetTargetHost(), path, stderr.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
 func (sshContext *SSHContext) GetBootID(host Host) (string, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
 	defer cancel()
@@ -288,7 +436,7 @@ func (sshContext *SSHContext) GetBootID(host Host) (string, error) {
 
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = sshContext.Output
 
 	err = cmd.Run()
 	if err != nil {
@@ -298,6 +446,54 @@ func (sshContext *SSHContext) GetBootID(host Host) (string, error) {
 	return strings.TrimSpace(stdout.String()), nil
 }
 
+// Probe a host coming back from a reboot: its boot ID, and the state of systemd, e.g. "starting", "running" or "degraded"
+func (sshContext *SSHContext) GetBootState(host Host) (bootID string, systemState string, err error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	cmd, err := sshContext.CmdContext(ctx, host, "sh", "-c", utils.ShellJoin("cat /proc/sys/kernel/random/boot_id; systemctl is-system-running 2>/dev/null; true"))
+	if err != nil {
+		return "", "", err
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			lines := strings.Split(message, "\n")
+			return "", "", errors.New(lines[len(lines)-1])
+		}
+		return "", "", err
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	bootID = strings.TrimSpace(lines[0])
+	if len(lines) > 1 {
+		systemState = strings.TrimSpace(lines[1])
+	}
+
+	return bootID, systemState, nil
+}
+
+// Whether the SSH port of the host accepts connections. Only meaningful if the host is reached directly, not through
+// aliases or jump hosts in the SSH config.
+func PortOpen(host Host) bool {
+	port := host.GetTargetPort()
+	if port == 0 {
+		port = 22
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host.GetTargetHost(), strconv.Itoa(port)), 3*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
+
 func (sshContext *SSHContext) MakeTempFile(host Host) (path string, err error) {
 	cmd, _ := sshContext.Cmd(host, "mktemp")
 
@@ -0,0 +1,677 @@
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/quetzal-deploy/quetzal/internal/events"
+)
+
+const (
+	statusWaiting    = "waiting"
+	statusRunning    = "running"
+	statusDone       = "done"
+	statusFailed     = "failed"
+	statusSkipped    = "skipped"
+	statusNotStarted = "not started"
+
+	redrawInterval = 200 * time.Millisecond
+	// Lines of the log of each failed host to print when the UI is closed
+	failedLogLines = 20
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorDim    = "\x1b[2m"
+	colorBold   = "\x1b[1m"
+	colorInvert = "\x1b[7m"
+)
+
+var escapeSequence = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+
+type check struct {
+	description string
+	passed      bool
+	err         string
+}
+
+type hostState struct {
+	name     string
+	status   string
+	phase    string
+	started  time.Time
+	finished time.Time
+	lastLine string
+	// Checks of the kind that ran most recently
+	checksKind string
+	checks     []*check
+	log        []string
+	// Output not terminated by a newline yet
+	partial string
+	err     string
+}
+
+func (host *hostState) elapsed() time.Duration {
+	switch {
+	case host.started.IsZero():
+		return 0
+	case host.finished.IsZero():
+		return time.Since(host.started)
+	default:
+		return host.finished.Sub(host.started)
+	}
+}
+
+func (host *hostState) write(text string) {
+	text = host.partial + text
+	lines := strings.Split(text, "\n")
+	host.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		line = sanitize(line)
+		host.log = append(host.log, line)
+		if strings.TrimSpace(line) != "" {
+			host.lastLine = strings.TrimSpace(line)
+		}
+	}
+	// show progress written without a trailing newline right away
+	if partial := strings.TrimSpace(sanitize(host.partial)); partial != "" {
+		host.lastLine = partial
+	}
+}
+
+func (host *hostState) check(description string) *check {
+	for _, c := range host.checks {
+		if c.description == description {
+			return c
+		}
+	}
+	c := &check{description: description}
+	host.checks = append(host.checks, c)
+	return c
+}
+
+// A full-screen view of the progress of each host, rendered from events. The log of the selected host can be expanded.
+type TUI struct {
+	out     *os.File
+	in      *os.File
+	inState *terminal.State
+
+	lock   sync.Mutex
+	title  string
+	start  time.Time
+	hosts  []*hostState
+	byName map[string]*hostState
+	// The output not tied to a host, e.g. from building
+	global *hostState
+	// Rendered events to print when the UI is closed, e.g. the summary of the run
+	final    bytes.Buffer
+	selected int
+	expanded bool
+	// Lines scrolled up from the end of the expanded log
+	scroll int
+	done   chan struct{}
+	closed bool
+	// While suspended, the terminal is given back, and keys are passed on to promptInput
+	suspended   bool
+	promptInput *io.PipeWriter
+}
+
+// Whether the UI can be shown on the file, i.e. it's a terminal capable of it
+func Available(out *os.File) bool {
+	return terminal.IsTerminal(int(out.Fd())) && os.Getenv("TERM") != "dumb"
+}
+
+func New(out *os.File, title string) *TUI {
+	return &TUI{
+		out:    out,
+		title:  title,
+		start:  time.Now(),
+		byName: make(map[string]*hostState),
+		global: &hostState{},
+		done:   make(chan struct{}),
+	}
+}
+
+// Switch the terminal to the UI. Keys are read from stdin, if it's a terminal too.
+func (ui *TUI) Start() {
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err == nil {
+			ui.in = os.Stdin
+			ui.inState = state
+			go ui.readKeys()
+		}
+	}
+
+	ui.enterScreen()
+
+	go func() {
+		ticker := time.NewTicker(redrawInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ui.done:
+				return
+			case <-ticker.C:
+				ui.draw()
+			}
+		}
+	}()
+}
+
+// Restore the terminal and print the outcome of each host, along with the end of the log of failed hosts
+func (ui *TUI) Close() {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	if ui.closed {
+		return
+	}
+	ui.closed = true
+	close(ui.done)
+
+	if ui.inState != nil {
+		terminal.Restore(int(ui.in.Fd()), ui.inState)
+	}
+	if !ui.suspended {
+		ui.leaveScreen()
+	}
+
+	table := tabwriter.NewWriter(ui.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "HOST\tSTATUS\tPHASE\tELAPSED")
+	for _, host := range ui.hosts {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", host.name, host.status, host.phase, formatElapsed(host.elapsed()))
+	}
+	table.Flush()
+
+	for _, host := range ui.hosts {
+		if host.status != statusFailed {
+			continue
+		}
+		fmt.Fprintf(ui.out, "\n==> %s: %s\n", host.name, host.err)
+		log := host.log
+		if len(log) > failedLogLines {
+			log = log[len(log)-failedLogLines:]
+		}
+		for _, line := range log {
+			fmt.Fprintln(ui.out, line)
+		}
+	}
+
+	ui.out.Write(ui.final.Bytes())
+}
+
+func (ui *TUI) host(name string) *hostState {
+	host, ok := ui.byName[name]
+	if !ok {
+		host = &hostState{name: name, status: statusWaiting}
+		ui.byName[name] = host
+		ui.hosts = append(ui.hosts, host)
+	}
+	return host
+}
+
+func (ui *TUI) Handle(record events.Record) {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	if ui.closed {
+		return
+	}
+
+	switch e := record.Event.(type) {
+	case events.HostsSelected:
+		for _, selected := range e.Hosts {
+			ui.host(selected.Name)
+		}
+		// the rows show the hosts already
+		return
+
+	case events.RunStarted:
+		if e.SwitchAction != "" {
+			ui.title += " " + e.SwitchAction
+		}
+
+	case events.RunFinished:
+		events.Render(&ui.final, e)
+		for _, outcome := range e.Summary {
+			if outcome.Status == "not-started" {
+				ui.host(outcome.Host).status = statusNotStarted
+			}
+		}
+
+	case events.HostStarted:
+		host := ui.host(e.Host)
+		host.status = statusRunning
+		host.started = record.Time
+
+	case events.HostFinished:
+		host := ui.host(e.Host)
+		host.finished = record.Time
+		if e.Error != "" {
+			host.status = statusFailed
+			host.err = e.Error
+			host.write(e.Error + "\n")
+		} else {
+			host.status = statusDone
+			host.phase = ""
+		}
+
+	case events.HostSkipped:
+		host := ui.host(e.Host)
+		host.status = statusSkipped
+		host.lastLine = e.Reason
+
+	case events.StepStarted:
+		if e.Host != "" {
+			ui.host(e.Host).phase = strings.TrimPrefix(e.Step, e.Host+":")
+		} else {
+			ui.global.phase = e.Step
+		}
+
+	case events.StepFinished:
+		if e.Host == "" {
+			ui.global.phase = ""
+		}
+
+	case events.ChecksStarted:
+		host := ui.host(e.Host)
+		if host.phase == "" {
+			host.phase = e.Kind
+		}
+		if host.checksKind != e.Kind {
+			host.checksKind = e.Kind
+			host.checks = nil
+		}
+
+	case events.CheckPassed:
+		c := ui.host(e.Host).check(e.Description)
+		c.passed = true
+		c.err = ""
+
+	case events.CheckFailed:
+		c := ui.host(e.Host).check(e.Description)
+		c.passed = false
+		c.err = e.Error
+	}
+
+	var text bytes.Buffer
+	events.Render(&text, record.Event)
+	if text.Len() == 0 {
+		return
+	}
+
+	if hostName := events.HostOf(record.Event); hostName != "" {
+		ui.host(hostName).write(text.String())
+	} else {
+		ui.global.write(text.String())
+		if _, ok := record.Event.(events.Log); ok {
+			// messages about the whole run are kept, e.g. why hosts weren't started
+			ui.final.Write(text.Bytes())
+		}
+	}
+}
+
+func (ui *TUI) enterScreen() {
+	// alternate screen, hidden cursor
+	fmt.Fprint(ui.out, "\x1b[?1049h\x1b[?25l")
+}
+
+func (ui *TUI) leaveScreen() {
+	fmt.Fprint(ui.out, "\x1b[?25h\x1b[?1049l")
+}
+
+// Give the terminal back, e.g. for asking the user. Keys typed meanwhile are passed on to the returned reader.
+func (ui *TUI) Suspend() io.Reader {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	if ui.closed || ui.suspended {
+		return nil
+	}
+	ui.suspended = true
+
+	ui.leaveScreen()
+	if ui.inState == nil {
+		return nil
+	}
+	// the terminal echoes and handles line editing again
+	terminal.Restore(int(ui.in.Fd()), ui.inState)
+	reader, writer := io.Pipe()
+	ui.promptInput = writer
+	return reader
+}
+
+func (ui *TUI) Resume() {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	if ui.closed || !ui.suspended {
+		return
+	}
+	ui.suspended = false
+
+	if ui.promptInput != nil {
+		ui.promptInput.Close()
+		ui.promptInput = nil
+		terminal.MakeRaw(int(ui.in.Fd()))
+	}
+	ui.enterScreen()
+	ui.drawLocked()
+}
+
+func (ui *TUI) readKeys() {
+	buffer := make([]byte, 64)
+	for {
+		n, err := ui.in.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		ui.lock.Lock()
+		promptInput := ui.promptInput
+		ui.lock.Unlock()
+		if promptInput != nil {
+			// written without holding the lock, since it blocks until the prompt has read it
+			promptInput.Write(buffer[:n])
+			continue
+		}
+
+		ui.handleKeys(string(buffer[:n]))
+	}
+}
+
+func (ui *TUI) handleKeys(keys string) {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	if ui.closed || ui.suspended {
+		return
+	}
+
+	for keys != "" {
+		key := keys[:1]
+		for _, sequence := range []string{"\x1b[A", "\x1b[B", "\x1b[5~", "\x1b[6~"} {
+			if strings.HasPrefix(keys, sequence) {
+				key = sequence
+			}
+		}
+		keys = keys[len(key):]
+
+		switch key {
+		case "\x03":
+			// the terminal doesn't turn ctrl-c into a signal in raw mode
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+		case "\x1b[A", "k":
+			if ui.expanded {
+				ui.scroll++
+			} else if ui.selected > 0 {
+				ui.selected--
+			}
+		case "\x1b[B", "j":
+			if ui.expanded {
+				if ui.scroll > 0 {
+					ui.scroll--
+				}
+			} else if ui.selected < len(ui.hosts)-1 {
+				ui.selected++
+			}
+		case "\x1b[5~":
+			if ui.expanded {
+				ui.scroll += 10
+			}
+		case "\x1b[6~":
+			if ui.expanded {
+				ui.scroll = max(ui.scroll-10, 0)
+			}
+		case "\r", "\n":
+			ui.expanded = !ui.expanded
+			ui.scroll = 0
+		case "\x1b", "q":
+			ui.expanded = false
+			ui.scroll = 0
+		}
+	}
+
+	ui.drawLocked()
+}
+
+func (ui *TUI) draw() {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	if !ui.closed && !ui.suspended {
+		ui.drawLocked()
+	}
+}
+
+func (ui *TUI) drawLocked() {
+	width, height, err := terminal.GetSize(int(ui.out.Fd()))
+	if err != nil || width < 20 || height < 5 {
+		width, height = 80, 24
+	}
+
+	var lines []string
+	if ui.expanded && len(ui.hosts) > 0 {
+		lines = ui.logView(width, height)
+	} else {
+		lines = ui.hostsView(width, height)
+	}
+
+	var frame bytes.Buffer
+	frame.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			frame.WriteString("\r\n")
+		}
+		frame.WriteString(line)
+		frame.WriteString("\x1b[K")
+	}
+	frame.WriteString("\x1b[J")
+	ui.out.Write(frame.Bytes())
+}
+
+func (ui *TUI) header(width int) string {
+	counts := make(map[string]int)
+	for _, host := range ui.hosts {
+		counts[host.status]++
+	}
+	summary := fmt.Sprintf("%d host(s)", len(ui.hosts))
+	for _, status := range []string{statusRunning, statusDone, statusFailed, statusSkipped, statusNotStarted} {
+		if counts[status] > 0 {
+			summary += fmt.Sprintf(", %d %s", counts[status], status)
+		}
+	}
+
+	title := fmt.Sprintf("%s - %s", ui.title, summary)
+	elapsed := formatElapsed(time.Since(ui.start))
+	return colorBold + pad(truncate(title, width-len(elapsed)-1), width-len(elapsed)) + elapsed + colorReset
+}
+
+func (ui *TUI) hostsView(width int, height int) []string {
+	lines := []string{ui.header(width)}
+
+	global := ui.global.lastLine
+	if ui.global.phase != "" {
+		global = ui.global.phase + ": " + global
+	}
+	lines = append(lines, colorDim+truncate(global, width)+colorReset, "")
+
+	nameWidth := len("HOST")
+	phaseWidth := len("PHASE")
+	for _, host := range ui.hosts {
+		nameWidth = max(nameWidth, utf8.RuneCountInString(host.name))
+		phaseWidth = max(phaseWidth, utf8.RuneCountInString(host.phase))
+	}
+	nameWidth = min(nameWidth, width/4)
+	phaseWidth = min(phaseWidth, width/4)
+	statusWidth := len(statusNotStarted)
+	elapsedWidth := 7
+	outputWidth := width - 2 - nameWidth - statusWidth - phaseWidth - elapsedWidth - 4
+
+	lines = append(lines, colorBold+"  "+pad("HOST", nameWidth)+" "+pad("STATUS", statusWidth)+" "+pad("PHASE", phaseWidth)+" "+pad("ELAPSED", elapsedWidth)+" OUTPUT"+colorReset)
+
+	// keep the selected host visible, with the help line at the bottom
+	available := height - len(lines) - 1
+	rows := [][]string{}
+	for i, host := range ui.hosts {
+		marker := "  "
+		if i == ui.selected {
+			marker = colorInvert + ">" + colorReset + " "
+		}
+		row := []string{
+			marker + pad(truncate(host.name, nameWidth), nameWidth) + " " +
+				statusColor(host.status) + pad(host.status, statusWidth) + colorReset + " " +
+				pad(truncate(host.phase, phaseWidth), phaseWidth) + " " +
+				pad(formatElapsed(host.elapsed()), elapsedWidth) + " " +
+				colorDim + truncate(host.lastLine, outputWidth) + colorReset,
+		}
+		if len(host.checks) > 0 {
+			row = append(row, "    "+host.checksKind+": "+checksLine(host.checks, width-6-len(host.checksKind)))
+		}
+		rows = append(rows, row)
+	}
+
+	first := 0
+	for {
+		used := 0
+		for i := first; i <= ui.selected && i < len(rows); i++ {
+			used += len(rows[i])
+		}
+		if used <= available || first >= ui.selected {
+			break
+		}
+		first++
+	}
+	for _, row := range rows[first:] {
+		if len(lines)+len(row) > height-1 {
+			break
+		}
+		lines = append(lines, row...)
+	}
+
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, colorDim+truncate("up/down: select host   enter: show log   ctrl-c: abort", width)+colorReset)
+
+	return lines
+}
+
+func (ui *TUI) logView(width int, height int) []string {
+	host := ui.hosts[ui.selected]
+	title := fmt.Sprintf("%s - %s", host.name, host.status)
+	if host.phase != "" {
+		title += ", " + host.phase
+	}
+	title += ", " + formatElapsed(host.elapsed())
+	lines := []string{colorBold + truncate(title, width) + colorReset}
+
+	log := host.log
+	if host.partial != "" {
+		log = append(log[:len(log):len(log)], sanitize(host.partial))
+	}
+
+	available := height - 2
+	ui.scroll = min(ui.scroll, max(len(log)-available, 0))
+	end := len(log) - ui.scroll
+	start := max(end-available, 0)
+	for _, line := range log[start:end] {
+		lines = append(lines, truncate(line, width))
+	}
+
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, colorDim+truncate("up/down, page up/down: scroll   esc: back to hosts   ctrl-c: abort", width)+colorReset)
+
+	return lines
+}
+
+func checksLine(checks []*check, width int) string {
+	var line, plain string
+	for _, c := range checks {
+		mark, color := "…", colorYellow
+		if c.passed {
+			mark, color = "✓", colorGreen
+		} else if c.err != "" {
+			mark, color = "✗", colorRed
+		}
+		entry := mark + " " + c.description + "  "
+		if utf8.RuneCountInString(plain+entry) > width {
+			line += "…"
+			break
+		}
+		plain += entry
+		line += color + mark + colorReset + " " + c.description + "  "
+	}
+	return line
+}
+
+func statusColor(status string) string {
+	switch status {
+	case statusRunning:
+		return colorYellow
+	case statusDone:
+		return colorGreen
+	case statusFailed:
+		return colorRed
+	default:
+		return colorDim
+	}
+}
+
+func formatElapsed(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	seconds := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// Make output safe to draw: no escape sequences, tabs or carriage returns, only the last of the progress updates
+func sanitize(line string) string {
+	if i := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	line = escapeSequence.ReplaceAllString(line, "")
+	line = strings.ReplaceAll(line, "\t", "    ")
+	return strings.Map(func(r rune) rune {
+		if r < ' ' {
+			return -1
+		}
+		return r
+	}, line)
+}
+
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
+
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
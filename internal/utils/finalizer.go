@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -13,7 +14,10 @@ type finalizer struct {
 }
 type FinalizerFunc func()
 
-var finalizers []*finalizer
+var (
+	finalizers     []*finalizer
+	finalizersLock sync.Mutex
+)
 
 /*
 Finalizers run sequentially at Quetzal shutdown - both at clean shutdown and on errors.
@@ -28,12 +32,18 @@ func (f *finalizer) Run() {
 }
 
 func RunFinalizers() {
+	finalizersLock.Lock()
+	defer finalizersLock.Unlock()
+
 	for _, f := range finalizers {
 		f.Run()
 	}
 }
 
 func AddFinalizer(f FinalizerFunc) {
+	finalizersLock.Lock()
+	defer finalizersLock.Unlock()
+
 	finalizers = append(finalizers, &finalizer{
 		function: f,
 		executed: false,
@@ -0,0 +1,16 @@
+package utils
+
+import (
+	"os"
+	"os/user"
+)
+
+// Describe who is running Quetzal, as the name of the user and of the machine. Unknown parts are left empty.
+func Operator() (username string, machine string) {
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+	machine, _ = os.Hostname()
+
+	return username, machine
+}
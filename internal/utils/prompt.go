@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Something that has taken over the terminal, e.g. a full-screen UI, and has to give it back for asking the user
+type TerminalOwner interface {
+	// Give back the terminal. Input typed meanwhile is passed on to the returned reader, if the owner reads stdin.
+	Suspend() io.Reader
+	Resume()
+}
+
+var (
+	terminalOwner     TerminalOwner
+	terminalOwnerLock sync.Mutex
+)
+
+func SetTerminalOwner(owner TerminalOwner) {
+	terminalOwnerLock.Lock()
+	defer terminalOwnerLock.Unlock()
+
+	terminalOwner = owner
+}
+
+func StdinIsTerminal() bool {
+	return terminal.IsTerminal(int(syscall.Stdin))
+}
+
+// Ask a yes/no question on stderr, and read the answer from stdin. Anything but "y" or "yes" is a no.
+// The question may span several lines, e.g. to describe what is about to happen.
+func Confirm(question string) (bool, error) {
+	terminalOwnerLock.Lock()
+	defer terminalOwnerLock.Unlock()
+
+	var input io.Reader = os.Stdin
+	if terminalOwner != nil {
+		if ownerInput := terminalOwner.Suspend(); ownerInput != nil {
+			input = ownerInput
+		}
+		defer terminalOwner.Resume()
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(os.Stderr)
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// Quote a command line so it can be copied into a shell, e.g. for showing commands without running them
+func ShellJoin(parts ...string) string {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		if shellSafe.MatchString(part) {
+			quoted[i] = part
+		} else if strings.Contains(part, "'") && !strings.ContainsAny(part, "$`\\\"!") {
+			quoted[i] = `"` + part + `"`
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(part, "'", `'"'"'`) + "'"
+		}
+	}
+
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,214 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/quetzal-deploy/quetzal/internal/common"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+)
+
+// Kinds of notifications
+const (
+	RunStarted    = "run-started"
+	HostSucceeded = "host-succeeded"
+	HostFailed    = "host-failed"
+	RunFinished   = "run-finished"
+)
+
+// How long to wait for notifications still being delivered when the run is done
+const closeTimeout = 30 * time.Second
+
+// What is sent to webhooks, as JSON or rendered with the template of the webhook
+type Payload struct {
+	Event        string   `json:"event"`
+	Command      string   `json:"command"`
+	Deployment   string   `json:"deployment"`
+	SwitchAction string   `json:"switchAction,omitempty"`
+	Hosts        []string `json:"hosts,omitempty"`
+	// For host notifications
+	Host      string `json:"host,omitempty"`
+	StorePath string `json:"storePath,omitempty"`
+	// Of the host, or of the whole run when it's finished
+	Duration time.Duration `json:"duration,omitempty"`
+	Success  bool          `json:"success"`
+	Error    string        `json:"error,omitempty"`
+	// For the finished run
+	FailedHosts []string `json:"failedHosts,omitempty"`
+}
+
+type delivery struct {
+	webhook common.Webhook
+	payload Payload
+}
+
+// Sends notifications about the progress of a run to webhooks. Notifications are delivered in order in the
+// background, so slow webhooks don't hold up the run, and failing deliveries are only logged.
+type Notifier struct {
+	webhooks   []common.Webhook
+	deployment string
+	client     *http.Client
+
+	queue chan delivery
+	done  sync.WaitGroup
+
+	// State of the run, for filling in payloads
+	started      time.Time
+	command      string
+	switchAction string
+	storePaths   map[string]string
+	failedHosts  []string
+}
+
+func NewNotifier(webhooks []common.Webhook, deployment string) *Notifier {
+	notifier := &Notifier{
+		webhooks:    webhooks,
+		deployment:  deployment,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan delivery, 1000),
+		storePaths:  make(map[string]string),
+		failedHosts: []string{},
+	}
+
+	notifier.done.Add(1)
+	go notifier.deliver()
+
+	return notifier
+}
+
+func (notifier *Notifier) Handle(record events.Record) {
+	switch e := record.Event.(type) {
+	case events.RunStarted:
+		notifier.started = record.Time
+		notifier.command = e.Command
+		notifier.switchAction = e.SwitchAction
+		notifier.notify(Payload{Event: RunStarted, Hosts: e.Hosts, Success: true})
+
+	case events.BuildFinished:
+		for host, path := range e.Paths {
+			notifier.storePaths[host] = path
+		}
+
+	case events.HostFinished:
+		if notifier.command == "" {
+			return
+		}
+		payload := Payload{
+			Event:     HostSucceeded,
+			Host:      e.Host,
+			StorePath: notifier.storePaths[e.Host],
+			Duration:  e.Duration,
+			Success:   e.Error == "",
+			Error:     e.Error,
+		}
+		if e.Error != "" {
+			payload.Event = HostFailed
+			notifier.failedHosts = append(notifier.failedHosts, e.Host)
+		}
+		notifier.notify(payload)
+
+	case events.RunFinished:
+		notifier.notify(Payload{
+			Event:       RunFinished,
+			Duration:    record.Time.Sub(notifier.started),
+			Success:     e.Error == "",
+			Error:       e.Error,
+			FailedHosts: notifier.failedHosts,
+		})
+	}
+}
+
+func (notifier *Notifier) notify(payload Payload) {
+	payload.Command = notifier.command
+	payload.Deployment = notifier.deployment
+	payload.SwitchAction = notifier.switchAction
+
+	for _, webhook := range notifier.webhooks {
+		select {
+		case notifier.queue <- delivery{webhook: webhook, payload: payload}:
+		default:
+			// never block the run, even if webhooks are way behind
+		}
+	}
+}
+
+func (notifier *Notifier) deliver() {
+	defer notifier.done.Done()
+
+	for d := range notifier.queue {
+		if err := notifier.post(d.webhook, d.payload); err != nil {
+			events.Publish(events.Log{Message: fmt.Sprintf("Warning: couldn't notify webhook %s about %s: %s", d.webhook.URL, d.payload.Event, err.Error())})
+		}
+	}
+}
+
+func render(webhook common.Webhook, payload Payload) (body []byte, contentType string, err error) {
+	if webhook.Template == "" {
+		body, err = json.Marshal(payload)
+		return body, "application/json", err
+	}
+
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		// quote a value for use in a JSON template, e.g. {"text": {{json .Error}}}
+		"json": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+	}).Parse(webhook.Template)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buffer bytes.Buffer
+	if err = tmpl.Execute(&buffer, payload); err != nil {
+		return nil, "", err
+	}
+
+	contentType = webhook.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return buffer.Bytes(), contentType, nil
+}
+
+func (notifier *Notifier) post(webhook common.Webhook, payload Payload) error {
+	body, contentType, err := render(webhook, payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := notifier.client.Post(webhook.URL, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("unexpected response: %s", response.Status))
+	}
+
+	return nil
+}
+
+// Wait for the remaining notifications to be delivered, for a while
+func (notifier *Notifier) Close() {
+	close(notifier.queue)
+
+	finished := make(chan bool)
+	go func() {
+		notifier.done.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(closeTimeout):
+		events.Publish(events.Log{Message: "Warning: gave up delivering webhook notifications"})
+	}
+}
@@ -8,7 +8,12 @@ import (
 	"github.com/DBCDK/kingpin"
 
 	"github.com/quetzal-deploy/quetzal/internal/cliparser"
+	"github.com/quetzal-deploy/quetzal/internal/common"
 	"github.com/quetzal-deploy/quetzal/internal/cruft"
+	"github.com/quetzal-deploy/quetzal/internal/daemon"
+	"github.com/quetzal-deploy/quetzal/internal/events"
+	"github.com/quetzal-deploy/quetzal/internal/report"
+	"github.com/quetzal-deploy/quetzal/internal/tui"
 	"github.com/quetzal-deploy/quetzal/internal/utils"
 )
 
@@ -16,7 +21,8 @@ import (
 var version string
 var assetRoot string
 
-func setup() {
+// Sets up events and returns a function for closing the terminal UI, if it's used
+func setup(opts *common.QuetzalOptions, clause string, interactive bool) func() {
 	utils.ValidateEnvironment("nix")
 
 	utils.SignalHandler()
@@ -24,27 +30,99 @@ func setup() {
 	if assetRoot == "" {
 		handleError(errors.New("Quetzal must be compiled with \"-ldflags=-X main.assetRoot=<path-to-installed-data/>\"."))
 	}
+
+	return setupEvents(opts, clause, interactive)
+}
+
+func setupEvents(opts *common.QuetzalOptions, clause string, interactive bool) func() {
+	closeUI := func() {}
+
+	// finalizers run in order, so this writes what's queued before the events file is closed
+	utils.AddFinalizer(events.Flush)
+
+	// the UI takes over the terminal, which makes asking for a password impossible
+	if interactive && !*opts.Plain && !opts.AskForSudoPasswd && tui.Available(os.Stderr) {
+		ui := tui.New(os.Stderr, "quetzal "+clause)
+		events.Subscribe(ui)
+		ui.Start()
+		utils.SetTerminalOwner(ui)
+		utils.AddFinalizer(ui.Close)
+		closeUI = ui.Close
+	} else {
+		// buffer output from hosts handled in parallel, so it isn't mixed together
+		events.Subscribe(events.NewQueuedSubscriber(events.NewHumanSubscriber(os.Stderr, opts.Parallel > 1)))
+	}
+
+	if *opts.EventsFile != "" {
+		eventsFile, err := os.Create(*opts.EventsFile)
+		handleError(err)
+		utils.AddFinalizer(func() {
+			eventsFile.Close()
+		})
+		events.Subscribe(events.NewQueuedSubscriber(events.NewJSONSubscriber(eventsFile)))
+	}
+
+	if *opts.EventsFd > 0 {
+		events.Subscribe(events.NewQueuedSubscriber(events.NewJSONSubscriber(os.NewFile(uintptr(*opts.EventsFd), "events"))))
+	}
+
+	return closeUI
 }
 
 func main() {
 
 	cli, cmdClauses, opts := cliparser.New(version, assetRoot)
-	clause := kingpin.MustParse(cli.Parse(os.Args[1:]))
+	clause := kingpin.MustParse(cli.Parse(cliparser.PrepareArgs(os.Args[1:])))
 
 	defer utils.RunFinalizers()
-	setup()
 
+	var interactive bool
+	switch clause {
+	case cmdClauses.Deploy.FullCommand(), cmdClauses.Push.FullCommand(), cmdClauses.HealthCheck.FullCommand():
+		interactive = true
+	}
+	closeUI := setup(opts, clause, interactive)
+
+	// Commands with their own JSON output use it, the others are summarized in a report built from events
+	var collector *report.Collector
+	if *opts.JsonOut {
+		switch clause {
+		case cmdClauses.Diff.FullCommand(), cmdClauses.Generations.List.FullCommand(), cmdClauses.Generations.Prune.FullCommand(), cmdClauses.History.FullCommand(), cmdClauses.Plan.FullCommand(), cmdClauses.SecretsList.FullCommand(), cmdClauses.Status.FullCommand():
+			opts.AsJson = true
+		default:
+			collector = report.NewCollector(clause)
+			events.Subscribe(collector)
+		}
+	}
+
+	err := run(clause, cmdClauses, opts)
+	events.Flush()
+
+	// restore the terminal before writing anything else
+	closeUI()
+
+	if collector != nil {
+		handleError(collector.Finish(err).PrintJson(os.Stdout))
+	}
+
+	handleError(err)
+}
+
+func run(clause string, cmdClauses *cliparser.KingpinCmdClauses, opts *common.QuetzalOptions) (err error) {
 	// evaluate without building hosts
 	switch clause {
 	case cmdClauses.Eval.FullCommand():
-		_, err := cruft.ExecEval(opts)
-		handleError(err)
-		return
+		_, err = cruft.ExecEval(opts)
+		return err
+	case cmdClauses.Daemon.FullCommand():
+		return daemon.Serve(opts)
 	}
 
 	// setup hosts
 	hosts, err := cruft.GetHosts(opts)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 
 	switch clause {
 	case cmdClauses.Build.FullCommand():
@@ -53,10 +131,22 @@ func main() {
 		_, err = cruft.ExecPush(opts, hosts)
 	case cmdClauses.Deploy.FullCommand():
 		_, err = cruft.ExecDeploy(opts, hosts)
+	case cmdClauses.Diff.FullCommand():
+		err = cruft.ExecDiff(opts, hosts)
+	case cmdClauses.Plan.FullCommand():
+		err = cruft.ExecPlan(opts, hosts)
+	case cmdClauses.Rollback.FullCommand():
+		err = cruft.ExecRollback(opts, hosts)
+	case cmdClauses.Generations.List.FullCommand():
+		err = cruft.ExecGenerationsList(opts, hosts)
+	case cmdClauses.Generations.Prune.FullCommand():
+		err = cruft.ExecGenerationsPrune(opts, hosts)
 	case cmdClauses.HealthCheck.FullCommand():
 		err = cruft.ExecHealthCheck(opts, hosts)
+	case cmdClauses.History.FullCommand():
+		err = cruft.ExecHistory(opts, hosts)
 	case cmdClauses.SecretsUpload.FullCommand():
-		err = cruft.ExecUploadSecrets(opts, hosts, nil)
+		err = cruft.ExecUploadSecrets(opts, hosts)
 	case cmdClauses.SecretsList.FullCommand():
 		if opts.AsJson {
 			err = cruft.ExecListSecretsAsJson(opts, hosts)
@@ -65,9 +155,11 @@ func main() {
 		}
 	case cmdClauses.Execute.FullCommand():
 		err = cruft.ExecExecute(opts, hosts)
+	case cmdClauses.Status.FullCommand():
+		err = cruft.ExecStatus(opts, hosts)
 	}
 
-	handleError(err)
+	return err
 }
 
 func handleError(err error) {